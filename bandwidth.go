@@ -0,0 +1,160 @@
+package main
+
+import (
+	"fmt"
+	"runtime"
+	"slices"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// BandwidthLimits limits the bandwidth of rclone, as rclone bandwidth timetables such as `10M`,
+// `10M:off` for separate upload and download limits, or `Mon-08:00,10M Mon-18:00,off` to limit by time of the week.
+// Commands are limited by the global limit and the limits of the remotes they access, whichever is lowest at any time.
+type BandwidthLimits struct {
+	// Global limits all commands.
+	Global string `config:"GLOBAL"`
+	// Source limits the commands accessing the source instance.
+	Source string `config:"SOURCE"`
+	// Dest limits the commands accessing the destination, including through the crypt remote.
+	Dest string `config:"DEST"`
+}
+
+// Validate checks the timetables of the limits.
+func (b BandwidthLimits) Validate() error {
+	for name, limit := range map[string]string{"global": b.Global, "source": b.Source, "dest": b.Dest} {
+		if limit == "" {
+			continue
+		}
+
+		var t fs.BwTimetable
+		if err := t.Set(limit); err != nil {
+			return fmt.Errorf("invalid %s bandwidth limit %q: %w", name, limit, err)
+		}
+	}
+
+	return nil
+}
+
+// For returns the timetable limiting a command accessing the remotes, or an empty string if it isn't limited.
+// If shares commands run concurrently, each of them gets an equal share of the bandwidth.
+func (b BandwidthLimits) For(remotes []string, shares int) (string, error) {
+	limits := []string{b.Global}
+	if slices.Contains(remotes, sourceName) {
+		limits = append(limits, b.Source)
+	}
+	if slices.Contains(remotes, destName) || slices.Contains(remotes, cryptName) {
+		limits = append(limits, b.Dest)
+	}
+
+	var out fs.BwTimetable
+	for _, limit := range limits {
+		if limit == "" {
+			continue
+		}
+
+		var t fs.BwTimetable
+		if err := t.Set(limit); err != nil {
+			return "", fmt.Errorf("invalid bandwidth limit %q: %w", limit, err)
+		}
+
+		if out == nil {
+			out = t
+		} else {
+			out = minTimetable(out, t)
+		}
+	}
+
+	if out == nil {
+		return "", nil
+	}
+
+	if shares > 1 {
+		for i := range out {
+			out[i].Bandwidth.Tx = shareBandwidth(out[i].Bandwidth.Tx, shares)
+			out[i].Bandwidth.Rx = shareBandwidth(out[i].Bandwidth.Rx, shares)
+		}
+	}
+
+	return out.String(), nil
+}
+
+// minTimetable merges two timetables into one applying the lower of both limits at any time.
+func minTimetable(a, b fs.BwTimetable) fs.BwTimetable {
+	var points []int
+	for _, t := range []fs.BwTimetable{a, b} {
+		for _, slot := range t {
+			points = append(points, weekMinute(slot))
+		}
+	}
+
+	slices.Sort(points)
+	points = slices.Compact(points)
+
+	out := make(fs.BwTimetable, 0, len(points))
+	for _, p := range points {
+		sa, sb := activeSlot(a, p), activeSlot(b, p)
+		out = append(out, fs.BwTimeSlot{
+			DayOfTheWeek: p / 10000,
+			HHMM:         p % 10000,
+			Bandwidth: fs.BwPair{
+				Tx: minBandwidth(sa.Bandwidth.Tx, sb.Bandwidth.Tx),
+				Rx: minBandwidth(sa.Bandwidth.Rx, sb.Bandwidth.Rx),
+			},
+		})
+	}
+
+	return out
+}
+
+// weekMinute returns the start of a slot as a comparable point in the week.
+func weekMinute(slot fs.BwTimeSlot) int {
+	return slot.DayOfTheWeek*10000 + slot.HHMM
+}
+
+// activeSlot returns the slot of the timetable in effect at the point of the week.
+// Before the first slot of the week, the last slot of the previous week is in effect.
+func activeSlot(t fs.BwTimetable, point int) fs.BwTimeSlot {
+	var active, last *fs.BwTimeSlot
+	for i := range t {
+		slot := &t[i]
+		if weekMinute(*slot) <= point && (active == nil || weekMinute(*slot) > weekMinute(*active)) {
+			active = slot
+		}
+		if last == nil || weekMinute(*slot) > weekMinute(*last) {
+			last = slot
+		}
+	}
+
+	if active == nil {
+		return *last
+	}
+
+	return *active
+}
+
+// minBandwidth returns the lower of two bandwidths, which are unlimited if not positive.
+func minBandwidth(a, b fs.SizeSuffix) fs.SizeSuffix {
+	switch {
+	case a <= 0:
+		return b
+	case b <= 0:
+		return a
+	default:
+		return min(a, b)
+	}
+}
+
+// shareBandwidth returns the share of a bandwidth of one of n concurrent commands.
+func shareBandwidth(bw fs.SizeSuffix, n int) fs.SizeSuffix {
+	if bw <= 0 {
+		return bw
+	}
+
+	return max(bw/fs.SizeSuffix(n), 1)
+}
+
+// bucketConcurrency returns the number of buckets synced concurrently out of n.
+func bucketConcurrency(n int) int {
+	return max(min(runtime.GOMAXPROCS(0), n), 1)
+}
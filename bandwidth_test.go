@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestBandwidthLimits(t *testing.T) {
+	limits := BandwidthLimits{
+		Global: "100M",
+		Dest:   "Mon-08:00,10M Mon-18:00,off",
+	}
+	if err := limits.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tc := range []struct {
+		remotes []string
+		shares  int
+		want    string
+	}{
+		{remotes: nil, want: "100Mi"},
+		{remotes: []string{sourceName}, shares: 4, want: "25Mi"},
+		{remotes: []string{sourceName, cryptName}, want: "Sun-00:00,100Mi Mon-08:00,10Mi Mon-18:00,100Mi"},
+		{remotes: []string{destName}, shares: 2, want: "Sun-00:00,50Mi Mon-08:00,5Mi Mon-18:00,50Mi"},
+	} {
+		got, err := limits.For(tc.remotes, tc.shares)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if got != tc.want {
+			t.Errorf("%v/%d: expected %q, got %q", tc.remotes, tc.shares, tc.want, got)
+		}
+	}
+
+	if got, _ := (BandwidthLimits{}).For([]string{destName}, 1); got != "" {
+		t.Errorf("expected no limit, got %q", got)
+	}
+
+	if err := (BandwidthLimits{Source: "fast"}).Validate(); err == nil {
+		t.Error("expected error for invalid limit")
+	}
+}
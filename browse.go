@@ -0,0 +1,151 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path"
+	"strings"
+	"time"
+)
+
+// splitBucketPath splits a bucket/key argument into the bucket and the key within it.
+func splitBucketPath(p string) (string, string, error) {
+	p = strings.TrimPrefix(p, "/")
+	bucket, key, _ := strings.Cut(p, "/")
+	if bucket == "" {
+		return "", "", fmt.Errorf("bucket is required")
+	}
+
+	if bucket == stateDir {
+		return "", "", fmt.Errorf("%s is not a bucket", stateDir)
+	}
+
+	return bucket, key, nil
+}
+
+// Ls prints the decrypted names of the files and directories of a backed up bucket.
+func Ls(ctx context.Context, target string, at *string, runID string, recursive bool) {
+	config, err := Config()
+	if err != nil {
+		panic(err)
+	}
+
+	l := slog.New(slog.NewTextHandler(os.Stderr, nil)).With("target", config.Crypt.Name)
+	at, _, err = resolveAt(ctx, config, at, runID, l)
+	if err != nil {
+		panic(err)
+	}
+
+	// without a bucket, list the buckets
+	if strings.Trim(target, "/") == "" {
+		buckets, err := RcloneListBucketsRemote(ctx, config, ListBucketsOptions{
+			Remote: config.Crypt.Name,
+			At:     at,
+			log:    l,
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		for _, bucket := range buckets {
+			fmt.Println(bucket + "/")
+		}
+
+		return
+	}
+
+	bucket, key, err := splitBucketPath(target)
+	if err != nil {
+		panic(err)
+	}
+
+	files, err := RcloneList(ctx, config, ListOptions{
+		Path:      path.Join(bucket, key),
+		Remote:    config.Crypt.Name,
+		At:        at,
+		Recursive: recursive,
+		log:       l,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	for _, f := range files {
+		name := f.Path
+		if f.IsDir {
+			name += "/"
+		}
+
+		fmt.Printf("%12d  %s  %s\n", f.Size, f.ModTime.Format(time.RFC3339), name)
+	}
+}
+
+// Get downloads and decrypts a single object, or all objects below a prefix, from a backed up bucket.
+// A single object can be written to stdout by passing - as output.
+func Get(ctx context.Context, target string, at *string, runID string, output string) {
+	config, err := Config()
+	if err != nil {
+		panic(err)
+	}
+
+	l := slog.New(slog.NewTextHandler(os.Stderr, nil)).With("target", config.Crypt.Name)
+	at, _, err = resolveAt(ctx, config, at, runID, l)
+	if err != nil {
+		panic(err)
+	}
+
+	bucket, key, err := splitBucketPath(target)
+	if err != nil {
+		panic(err)
+	}
+
+	remotePath := path.Join(bucket, key)
+	info, err := RcloneStat(ctx, config, StatOptions{
+		Path:   remotePath,
+		Remote: config.Crypt.Name,
+		At:     at,
+		log:    l,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	if output == "" {
+		output = path.Base(remotePath)
+	}
+
+	if output == "-" {
+		if info.IsDir {
+			panic(fmt.Errorf("%s is a prefix, it can't be written to stdout", target))
+		}
+
+		err = RcloneCat(ctx, config, CatOptions{
+			Path:   remotePath,
+			Source: config.Crypt.Name,
+			At:     at,
+			Out:    os.Stdout,
+			log:    l,
+		})
+		if err != nil {
+			panic(err)
+		}
+
+		return
+	}
+
+	err = RcloneCopy(ctx, config, CopyOptions{
+		Path:   remotePath,
+		Source: config.Crypt.Name,
+		Dest:   output,
+		At:     at,
+		File:   !info.IsDir,
+		log:    l,
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	l.Info("downloaded", "path", target, "output", output)
+}
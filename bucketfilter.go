@@ -0,0 +1,166 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"path"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+)
+
+const (
+	// skipTagKey is the bucket tag opting a bucket out of backups, if set to skipTagValue.
+	skipTagKey   = "s32s3/skip"
+	skipTagValue = "true"
+)
+
+// BucketFilter selects the buckets to back up.
+// Patterns are comma separated globs, or regular expressions if enclosed in slashes, such as `/^tmp-\d+$/`.
+type BucketFilter struct {
+	// Include lists the buckets to back up, all are backed up if empty.
+	Include string `config:"INCLUDE"`
+	// Exclude lists the buckets not to back up.
+	Exclude string `config:"EXCLUDE"`
+}
+
+// bucketMatcher is a compiled BucketFilter.
+type bucketMatcher struct {
+	include []func(string) bool
+	exclude []func(string) bool
+}
+
+// Compile parses the patterns of the filter.
+func (f BucketFilter) Compile() (bucketMatcher, error) {
+	include, err := compileBucketPatterns(f.Include)
+	if err != nil {
+		return bucketMatcher{}, fmt.Errorf("include: %w", err)
+	}
+
+	exclude, err := compileBucketPatterns(f.Exclude)
+	if err != nil {
+		return bucketMatcher{}, fmt.Errorf("exclude: %w", err)
+	}
+
+	return bucketMatcher{include: include, exclude: exclude}, nil
+}
+
+func compileBucketPatterns(s string) ([]func(string) bool, error) {
+	var out []func(string) bool
+	for _, p := range splitList(s) {
+		if expr, ok := strings.CutPrefix(p, "/"); ok && strings.HasSuffix(expr, "/") {
+			re, err := regexp.Compile(strings.TrimSuffix(expr, "/"))
+			if err != nil {
+				return nil, fmt.Errorf("invalid regular expression %q: %w", p, err)
+			}
+
+			out = append(out, re.MatchString)
+			continue
+		}
+
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid glob %q: %w", p, err)
+		}
+
+		out = append(out, func(name string) bool {
+			ok, _ := path.Match(p, name)
+			return ok
+		})
+	}
+
+	return out, nil
+}
+
+// Match reports whether the bucket is selected, and the reason if it isn't.
+func (m bucketMatcher) Match(bucket string) (bool, string) {
+	match := func(patterns []func(string) bool) bool {
+		return slices.ContainsFunc(patterns, func(f func(string) bool) bool { return f(bucket) })
+	}
+
+	if len(m.include) > 0 && !match(m.include) {
+		return false, "not included"
+	}
+
+	if match(m.exclude) {
+		return false, "excluded"
+	}
+
+	return true, ""
+}
+
+// sameInstance reports whether two S3 endpoints point to the same instance.
+func sameInstance(a, b string) bool {
+	ua, err := url.Parse(a)
+	if err != nil {
+		return false
+	}
+
+	ub, err := url.Parse(b)
+	if err != nil {
+		return false
+	}
+
+	return ua.Host != "" && strings.EqualFold(ua.Host, ub.Host)
+}
+
+// SkipTagged reports whether the bucket opted out of backups through the skipTagKey tag.
+func (m *Minio) SkipTagged(ctx context.Context, bucket string) (bool, error) {
+	t, err := m.client.GetBucketTagging(ctx, bucket)
+	switch minio.ToErrorResponse(err).Code {
+	case "NoSuchTagSet", "NotImplemented":
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+
+	return t.ToMap()[skipTagKey] == skipTagValue, nil
+}
+
+// SelectBuckets returns the buckets of the instance to back up, and the ones left out.
+// The backup bucket is always left out if the destination is the same instance.
+func (m *Minio) SelectBuckets(ctx context.Context, config BackupConfig) ([]string, []string, error) {
+	matcher, err := config.Buckets.Compile()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	buckets, err := m.ListBuckets(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	self := sameInstance(config.Source.Value.Endpoint, config.Dest.Value.Endpoint)
+
+	var selected, skipped []string
+	for _, bucket := range buckets {
+		ok, reason := matcher.Match(bucket)
+		if ok && self && bucket == config.BackupBucket {
+			ok, reason = false, "backup bucket"
+		}
+
+		if ok {
+			tagged, err := m.SkipTagged(ctx, bucket)
+			if err != nil {
+				return nil, nil, fmt.Errorf("get tags of bucket %s: %w", bucket, err)
+			}
+
+			if tagged {
+				ok, reason = false, fmt.Sprintf("tagged %s=%s", skipTagKey, skipTagValue)
+			}
+		}
+
+		if !ok {
+			m.log.Info("skipping bucket", "bucket", bucket, "reason", reason)
+			skipped = append(skipped, bucket)
+			continue
+		}
+
+		selected = append(selected, bucket)
+	}
+
+	return selected, skipped, nil
+}
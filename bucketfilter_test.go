@@ -0,0 +1,38 @@
+package main
+
+import "testing"
+
+func TestBucketFilter(t *testing.T) {
+	matcher, err := BucketFilter{
+		Include: "app-*, /^logs-[0-9]+$/",
+		Exclude: "*-cache,/scratch/",
+	}.Compile()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for bucket, want := range map[string]bool{
+		"app-data":         true,
+		"app-cache":        false,
+		"app-scratch-area": false,
+		"logs-2024":        true,
+		"logs-old":         false,
+		"other":            false,
+	} {
+		if got, reason := matcher.Match(bucket); got != want {
+			t.Errorf("%s: expected %v, got %v (%s)", bucket, want, got, reason)
+		}
+	}
+
+	if _, err := (BucketFilter{Exclude: "/[/"}).Compile(); err == nil {
+		t.Error("expected error for invalid regular expression")
+	}
+
+	if !sameInstance("https://minio.example.com", "https://MINIO.example.com/") {
+		t.Error("expected same instance")
+	}
+
+	if sameInstance("https://minio.example.com", "https://backup.example.com") {
+		t.Error("expected different instances")
+	}
+}
@@ -7,6 +7,7 @@ import (
 	"reflect"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/rclone/rclone/backend/crypt"
 	"github.com/rclone/rclone/backend/s3"
@@ -25,8 +26,21 @@ type (
 		Source Wrapped[s3.Options]    `config:"SOURCE"`
 		Crypt  Wrapped[crypt.Options] `config:"CRYPT"`
 
-		BackupBucket   string `config:"BACKUP_BUCKET"`
-		ExpirationDays int    `config:"EXPIRATION_DAYS"`
+		BackupBucket      string          `config:"BACKUP_BUCKET"`
+		ExpirationDays    int             `config:"EXPIRATION_DAYS"`
+		BackupMode        string          `config:"BACKUP_MODE"`
+		DeletionGraceDays int             `config:"DELETION_GRACE_DAYS"`
+		DeleteGuard       DeleteGuard     `config:"MAX_DELETE"`
+		Bandwidth         BandwidthLimits `config:"BWLIMIT"`
+		Retry             RetryPolicy     `config:"RETRY"`
+		Progress          ProgressConfig  `config:"PROGRESS"`
+		Serve             ServeConfig     `config:"SERVE"`
+		Webhooks          string          `config:"NOTIFY_WEBHOOKS"`
+		Tracing           TracingConfig   `config:"TRACING"`
+		Buckets           BucketFilter    `config:"BACKUP"`
+		ObjectFilters     string          `config:"BACKUP_FILTERS"`
+		Retention         RetentionPolicy `config:"KEEP"`
+		RestoreConfig     ConfigFilter    `config:"RESTORE_CONFIG"`
 	}
 )
 
@@ -65,11 +79,8 @@ const (
 	bucketName = "backups"
 )
 
+// Validate checks the configuration required by all commands, which is the destination and encryption.
 func (c BackupConfig) Validate() error {
-	if c.Source.Value.Endpoint == "" {
-		return fmt.Errorf("source endpoint is required")
-	}
-
 	if c.Dest.Value.Endpoint == "" {
 		return fmt.Errorf("dest endpoint is required")
 	}
@@ -85,6 +96,16 @@ func (c BackupConfig) Validate() error {
 	return nil
 }
 
+// ValidateSource checks the configuration required by commands accessing the source instance.
+// It's separate from Validate, as restoring to a local directory works without a source.
+func (c BackupConfig) ValidateSource() error {
+	if c.Source.Value.Endpoint == "" {
+		return fmt.Errorf("source endpoint is required")
+	}
+
+	return nil
+}
+
 func ConfigFromEnv(c map[string]string) (BackupConfig, error) {
 	out := BackupConfig{
 		Dest: Wrapped[s3.Options]{
@@ -107,6 +128,15 @@ func ConfigFromEnv(c map[string]string) (BackupConfig, error) {
 			},
 		},
 		BackupBucket: bucketName,
+		Retry: RetryPolicy{
+			Attempts:   3,
+			Backoff:    "30s",
+			MaxBackoff: "5m",
+			Jitter:     0.2,
+		},
+		Progress: ProgressConfig{
+			Interval: "1m",
+		},
 	}
 
 	err := fromEnvStruct(c, "", &out)
@@ -132,6 +162,26 @@ func ConfigFromEnv(c map[string]string) (BackupConfig, error) {
 		return BackupConfig{}, err
 	}
 
+	if err := out.Bandwidth.Validate(); err != nil {
+		return BackupConfig{}, err
+	}
+
+	if err := out.Retry.Validate(); err != nil {
+		return BackupConfig{}, err
+	}
+
+	if _, err := time.ParseDuration(out.Progress.Interval); err != nil {
+		return BackupConfig{}, fmt.Errorf("invalid progress interval %q: %w", out.Progress.Interval, err)
+	}
+
+	if _, err := ParseWebhooks(out.Webhooks); err != nil {
+		return BackupConfig{}, err
+	}
+
+	if err := out.Tracing.Validate(); err != nil {
+		return BackupConfig{}, err
+	}
+
 	if os.Getenv("DEBUG_CONFIG") != "" {
 		EncodeConfig(os.Stderr, out)
 	}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math"
+	"os/exec"
+)
+
+// DeleteGuard limits the objects a backup run may delete from the backup of a bucket,
+// so that a wiped source, or a source wrongly listing a bucket as empty, doesn't wipe the backup as well.
+// Zero values don't limit deletions.
+type DeleteGuard struct {
+	// MaxPercent is the percentage of the objects in the backup of a bucket that may be deleted.
+	MaxPercent float64 `config:"PERCENT"`
+	// MaxCount is the number of objects that may be deleted from the backup of a bucket.
+	MaxCount int `config:"COUNT"`
+}
+
+// Enabled reports whether deletions are limited.
+func (g DeleteGuard) Enabled() bool {
+	return g.MaxPercent > 0 || g.MaxCount > 0
+}
+
+// Limit returns the number of objects that may be deleted from a backup of total objects.
+func (g DeleteGuard) Limit(total int) int {
+	limit := math.MaxInt
+	if g.MaxCount > 0 {
+		limit = g.MaxCount
+	}
+
+	if g.MaxPercent > 0 {
+		limit = min(limit, int(math.Floor(float64(total)*g.MaxPercent/100)))
+	}
+
+	return limit
+}
+
+// Check returns a *MassDeletionError if deleting deletes out of total objects exceeds the limits.
+func (g DeleteGuard) Check(deletes, total int) error {
+	if !g.Enabled() {
+		return nil
+	}
+
+	if limit := g.Limit(total); deletes > limit {
+		return &MassDeletionError{Deletes: deletes, Total: total, Limit: limit}
+	}
+
+	return nil
+}
+
+// MassDeletionError is returned when a backup run would delete more objects from a backup than allowed by the DeleteGuard.
+// Aborted is set if rclone stopped syncing at the limit, as the source changed after the planned deletions were checked.
+type MassDeletionError struct {
+	Deletes int
+	Total   int
+	Limit   int
+	Aborted bool
+}
+
+func (e *MassDeletionError) Error() string {
+	if e.Aborted {
+		return fmt.Sprintf("mass deletion prevented: sync stopped after deleting %d of %d objects from the backup, the limit", e.Limit, e.Total)
+	}
+
+	return fmt.Sprintf("mass deletion prevented: %d of %d objects would be deleted from the backup, limit is %d", e.Deletes, e.Total, e.Limit)
+}
+
+// rcloneExitFatal is the exit code of rclone for fatal errors, including exceeding --max-delete.
+const rcloneExitFatal = 7
+
+// maxDeleteError returns a *MassDeletionError if a sync run with --max-delete limit failed with a fatal error,
+// which is how rclone aborts when the limit is reached. Other errors are returned as they are.
+func maxDeleteError(err error, limit, total int) error {
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == rcloneExitFatal {
+		return &MassDeletionError{Deletes: limit + 1, Total: total, Limit: limit, Aborted: true}
+	}
+
+	return err
+}
+
+type PlannedDeletesOptions struct {
+	Bucket   string
+	Source   string
+	Dest     string
+	SourceAt *string
+	Filter   *ObjectFilter
+	log      *slog.Logger
+}
+
+// RclonePlannedDeletes returns the number of objects syncing a bucket would delete from its backup,
+// and the number of objects in the backup.
+func RclonePlannedDeletes(ctx context.Context, config BackupConfig, opts PlannedDeletesOptions) (int, int, error) {
+	source, err := RcloneListObjects(ctx, config, ListOptions{
+		Path:     opts.Bucket,
+		Remote:   opts.Source,
+		SourceAt: opts.SourceAt,
+		Filter:   opts.Filter,
+		log:      opts.log,
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("list source: %w", err)
+	}
+
+	backup, err := RcloneListObjects(ctx, config, ListOptions{
+		Path:   opts.Bucket,
+		Remote: opts.Dest,
+		Filter: opts.Filter,
+		log:    opts.log,
+	})
+	if err != nil {
+		return 0, 0, fmt.Errorf("list backup: %w", err)
+	}
+
+	return len(missingFrom(backup, source)), len(backup), nil
+}
+
+// missingFrom returns the names of a missing from b.
+func missingFrom(a, b []string) []string {
+	present := make(map[string]bool, len(b))
+	for _, name := range b {
+		present[name] = true
+	}
+
+	var out []string
+	for _, name := range a {
+		if !present[name] {
+			out = append(out, name)
+		}
+	}
+
+	return out
+}
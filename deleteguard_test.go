@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"os/exec"
+	"slices"
+	"testing"
+)
+
+func TestDeleteGuard(t *testing.T) {
+	if err := (DeleteGuard{}).Check(100, 100); err != nil {
+		t.Errorf("expected disabled guard to allow deletions, got %v", err)
+	}
+
+	guard := DeleteGuard{MaxPercent: 10, MaxCount: 50}
+	for _, tc := range []struct {
+		deletes, total int
+		ok             bool
+	}{
+		{deletes: 10, total: 100, ok: true},
+		{deletes: 11, total: 100, ok: false},
+		{deletes: 50, total: 1000, ok: true},
+		{deletes: 51, total: 1000, ok: false},
+		{deletes: 0, total: 0, ok: true},
+	} {
+		err := guard.Check(tc.deletes, tc.total)
+		var massErr *MassDeletionError
+		if tc.ok && err != nil {
+			t.Errorf("%d of %d: expected no error, got %v", tc.deletes, tc.total, err)
+		}
+		if !tc.ok && !errors.As(err, &massErr) {
+			t.Errorf("%d of %d: expected mass deletion error, got %v", tc.deletes, tc.total, err)
+		}
+	}
+
+	fatal := exec.Command("sh", "-c", "exit 7").Run()
+	var massErr *MassDeletionError
+	if err := maxDeleteError(fatal, 10, 100); !errors.As(err, &massErr) || !massErr.Aborted || massErr.Limit != 10 {
+		t.Errorf("expected aborted mass deletion error, got %v", err)
+	}
+
+	temporary := exec.Command("sh", "-c", "exit 5").Run()
+	if err := maxDeleteError(temporary, 10, 100); err != temporary {
+		t.Errorf("expected other errors unchanged, got %v", err)
+	}
+
+	if got := missingFrom([]string{"a", "b", "c"}, []string{"b"}); !slices.Equal(got, []string{"a", "c"}) {
+		t.Errorf("expected a and c missing, got %q", got)
+	}
+}
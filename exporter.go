@@ -0,0 +1,113 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// providerMinio is the rclone provider name of MinIO.
+const providerMinio = "Minio"
+
+// MetadataExporter exports and restores the instance metadata of a source.
+// Which parts of the metadata exist depends on the provider of the source.
+type MetadataExporter interface {
+	// Source identifies the instance, it is recorded in the manifest of the archive.
+	Source(ctx context.Context) (ManifestSource, error)
+	// Export spools the metadata of the instance into files in dir.
+	Export(ctx context.Context, dir string) ([]metaEntry, error)
+	// Restore restores the parts of an archive selected by opts onto the instance.
+	Restore(ctx context.Context, archive MetaArchive, opts RestoreMetaOptions) error
+}
+
+// NewMetadataExporter returns the exporter for the provider of the instance.
+// MinIO, which is assumed if no provider is set, is exported through the admin API,
+// any other provider through the plain S3 API.
+func NewMetadataExporter(m *Minio) MetadataExporter {
+	if m.config.Provider == "" || strings.EqualFold(m.config.Provider, providerMinio) {
+		return MinioExporter{m: m}
+	}
+
+	return S3Exporter{m: m}
+}
+
+// ExportMetadata exports the metadata of an instance into a metadata archive.
+// The archive is stored in a temporary directory, and the path to the file is returned.
+func ExportMetadata(ctx context.Context, exporter MetadataExporter) (string, error) {
+	dir, err := os.MkdirTemp("", "s32s3-*")
+	if err != nil {
+		return "", err
+	}
+
+	source, err := exporter.Source(ctx)
+	if err != nil {
+		return "", err
+	}
+
+	manifest := Manifest{
+		CreatedAt:   time.Now().UTC(),
+		ToolVersion: toolVersion(),
+		Source:      source,
+	}
+
+	entries, err := exporter.Export(ctx, dir)
+	if err != nil {
+		return "", err
+	}
+
+	manifest.ContentHash, err = contentHash(entries)
+	if err != nil {
+		return "", err
+	}
+
+	f, err := os.Create(filepath.Join(dir, SourceMetadata))
+	if err != nil {
+		return "", err
+	}
+
+	err = writeMetaArchive(f, manifest, entries)
+	if err != nil {
+		f.Close()
+		return "", err
+	}
+
+	if err := f.Close(); err != nil {
+		return "", err
+	}
+
+	for _, e := range entries {
+		os.Remove(e.path)
+	}
+
+	return f.Name(), nil
+}
+
+// RestoreMetadata restores the parts of the metadata archive at meta selected by opts.
+// Nothing is restored if the archive fails verification.
+func RestoreMetadata(ctx context.Context, exporter MetadataExporter, meta string, opts RestoreMetaOptions, log *slog.Logger) error {
+	dir, err := os.MkdirTemp("", "s32s3-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	archive, err := ReadMetaArchive(meta, dir)
+	if err != nil {
+		return fmt.Errorf("read metadata archive: %w", err)
+	}
+
+	log.Info("verified metadata archive",
+		"format", archive.Manifest.FormatVersion,
+		"created", archive.Manifest.CreatedAt,
+		"tool", archive.Manifest.ToolVersion,
+		"provider", archive.Manifest.Source.Provider,
+		"minio", archive.Manifest.Source.MinioVersion,
+		"deployment", archive.Manifest.Source.DeploymentID,
+	)
+
+	return exporter.Restore(ctx, archive, opts)
+}
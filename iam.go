@@ -0,0 +1,660 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/minio/madmin-go/v3"
+)
+
+// Files of the IAM export archive, as written by the ExportIAM admin API.
+const (
+	iamAssetsDir              = "iam-assets"
+	iamPoliciesFile           = "policies.json"
+	iamUsersFile              = "users.json"
+	iamGroupsFile             = "groups.json"
+	iamServiceAccountsFile    = "svcaccts.json"
+	iamUserPolicyMappingsFile = "user_mappings.json"
+	iamGroupPolicyMappingFile = "group_mappings.json"
+)
+
+// Kinds of IAM entities which can be restored individually.
+const (
+	iamPolicy         = "policy"
+	iamUser           = "user"
+	iamGroup          = "group"
+	iamServiceAccount = "service-account"
+)
+
+// iamNotFoundCodes are the admin API error codes returned for IAM entities which don't exist.
+var iamNotFoundCodes = []string{
+	"XMinioAdminNoSuchPolicy",
+	"XMinioAdminNoSuchUser",
+	"XMinioAdminNoSuchGroup",
+	"XMinioAdminNoSuchServiceAccount",
+	"XMinioAdminServiceAccountNotFound",
+}
+
+// IAMUser is an internal user with the policies attached to it.
+type IAMUser struct {
+	SecretKey string
+	Status    madmin.AccountStatus
+	Policies  []string
+}
+
+// IAMGroup is a group with its members and the policies attached to it.
+type IAMGroup struct {
+	Status   string
+	Members  []string
+	Policies []string
+}
+
+// IAMExport holds the IAM entities of an instance, either parsed from an IAM export archive or read from the live instance.
+type IAMExport struct {
+	Policies        map[string]json.RawMessage
+	Users           map[string]IAMUser
+	Groups          map[string]IAMGroup
+	ServiceAccounts map[string]madmin.SRSvcAccCreate
+}
+
+type iamMappedPolicy struct {
+	Policy string `json:"policy"`
+}
+
+// ParseIAMExport parses an IAM export archive. Files missing from the archive are treated as empty.
+func ParseIAMExport(r io.ReaderAt, size int64) (IAMExport, error) {
+	archive, err := zip.NewReader(r, size)
+	if err != nil {
+		return IAMExport{}, fmt.Errorf("open iam archive: %w", err)
+	}
+
+	read := func(name string, v any) error {
+		f, err := archive.Open(path.Join(iamAssetsDir, name))
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+
+		err = json.NewDecoder(f).Decode(v)
+		if err != nil {
+			return fmt.Errorf("parse %s: %w", name, err)
+		}
+
+		return nil
+	}
+
+	var users map[string]madmin.AddOrUpdateUserReq
+	var groups map[string]madmin.GroupDesc
+	var userMappings, groupMappings map[string]iamMappedPolicy
+	out := IAMExport{}
+	for name, v := range map[string]any{
+		iamPoliciesFile:           &out.Policies,
+		iamUsersFile:              &users,
+		iamGroupsFile:             &groups,
+		iamServiceAccountsFile:    &out.ServiceAccounts,
+		iamUserPolicyMappingsFile: &userMappings,
+		iamGroupPolicyMappingFile: &groupMappings,
+	} {
+		if err := read(name, v); err != nil {
+			return IAMExport{}, err
+		}
+	}
+
+	out.Users = map[string]IAMUser{}
+	for name, u := range users {
+		policy := u.Policy
+		if m, ok := userMappings[name]; ok {
+			policy = m.Policy
+		}
+
+		out.Users[name] = IAMUser{SecretKey: u.SecretKey, Status: u.Status, Policies: splitList(policy)}
+	}
+
+	out.Groups = map[string]IAMGroup{}
+	for name, g := range groups {
+		policy := g.Policy
+		if m, ok := groupMappings[name]; ok {
+			policy = m.Policy
+		}
+
+		out.Groups[name] = IAMGroup{Status: g.Status, Members: g.Members, Policies: splitList(policy)}
+	}
+
+	for name, sa := range out.ServiceAccounts {
+		sa.Status = serviceAccountStatus(sa.Status)
+		out.ServiceAccounts[name] = sa
+	}
+
+	return out, nil
+}
+
+// serviceAccountStatus normalizes the on and off status of service accounts
+// to the enabled and disabled status of users and groups.
+func serviceAccountStatus(status string) string {
+	switch status {
+	case "on":
+		return string(madmin.AccountEnabled)
+	case "off":
+		return string(madmin.AccountDisabled)
+	}
+
+	return status
+}
+
+// IAMSelection selects IAM entities by name, globs are allowed.
+type IAMSelection struct {
+	Policies        []string
+	Users           []string
+	Groups          []string
+	ServiceAccounts []string
+}
+
+// Empty reports whether no entity is selected.
+func (s IAMSelection) Empty() bool {
+	return len(s.Policies) == 0 && len(s.Users) == 0 && len(s.Groups) == 0 && len(s.ServiceAccounts) == 0
+}
+
+// Resolve returns the names of the entities in the export matching the selection.
+// Every pattern has to match at least one entity.
+func (s IAMSelection) Resolve(export IAMExport) (IAMSelection, error) {
+	var err error
+	out := IAMSelection{}
+	out.Policies, err = matchNames(iamPolicy, s.Policies, mapKeys(export.Policies))
+	if err != nil {
+		return IAMSelection{}, err
+	}
+
+	out.Users, err = matchNames(iamUser, s.Users, mapKeys(export.Users))
+	if err != nil {
+		return IAMSelection{}, err
+	}
+
+	out.Groups, err = matchNames(iamGroup, s.Groups, mapKeys(export.Groups))
+	if err != nil {
+		return IAMSelection{}, err
+	}
+
+	out.ServiceAccounts, err = matchNames(iamServiceAccount, s.ServiceAccounts, mapKeys(export.ServiceAccounts))
+	if err != nil {
+		return IAMSelection{}, err
+	}
+
+	return out, nil
+}
+
+func matchNames(kind string, patterns []string, names []string) ([]string, error) {
+	var out []string
+	for _, p := range patterns {
+		found := false
+		for _, name := range names {
+			if ok, _ := path.Match(p, name); ok {
+				found = true
+				if !slices.Contains(out, name) {
+					out = append(out, name)
+				}
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("%s %q not found in metadata archive", kind, p)
+		}
+	}
+
+	return out, nil
+}
+
+func mapKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	return keys
+}
+
+// IAMChange describes the difference of an IAM entity between the archive and the live instance.
+type IAMChange struct {
+	Kind string
+	Name string
+	// Create is set if the entity doesn't exist on the live instance.
+	Create bool
+	// Changes describes the differing fields, it is empty if the entity is unchanged.
+	Changes []string
+}
+
+// Unchanged reports whether the live entity matches the archive.
+func (c IAMChange) Unchanged() bool {
+	return !c.Create && len(c.Changes) == 0
+}
+
+func (c IAMChange) String() string {
+	action := "update"
+	switch {
+	case c.Create:
+		action = "create"
+	case c.Unchanged():
+		action = "unchanged"
+	}
+
+	return fmt.Sprintf("%s\t%s\t%s\t%s", action, c.Kind, c.Name, strings.Join(c.Changes, "; "))
+}
+
+// DiffIAM compares the selected entities of the archive with the live instance.
+func DiffIAM(archived, live IAMExport, sel IAMSelection) []IAMChange {
+	var out []IAMChange
+	for _, name := range sel.Policies {
+		c := IAMChange{Kind: iamPolicy, Name: name}
+		current, ok := live.Policies[name]
+		switch {
+		case !ok:
+			c.Create = true
+		case !jsonEqual(archived.Policies[name], current):
+			c.Changes = append(c.Changes, "policy document differs")
+		}
+		out = append(out, c)
+	}
+
+	for _, name := range sel.Users {
+		c := IAMChange{Kind: iamUser, Name: name}
+		want := archived.Users[name]
+		current, ok := live.Users[name]
+		if !ok {
+			c.Create = true
+		} else {
+			c.Changes = appendChange(c.Changes, "status", string(current.Status), string(want.Status))
+			c.Changes = appendListChange(c.Changes, "policies", current.Policies, want.Policies)
+		}
+		out = append(out, c)
+	}
+
+	for _, name := range sel.Groups {
+		c := IAMChange{Kind: iamGroup, Name: name}
+		want := archived.Groups[name]
+		current, ok := live.Groups[name]
+		if !ok {
+			c.Create = true
+		} else {
+			c.Changes = appendChange(c.Changes, "status", current.Status, want.Status)
+			c.Changes = appendListChange(c.Changes, "members", current.Members, want.Members)
+			c.Changes = appendListChange(c.Changes, "policies", current.Policies, want.Policies)
+		}
+		out = append(out, c)
+	}
+
+	for _, name := range sel.ServiceAccounts {
+		c := IAMChange{Kind: iamServiceAccount, Name: name}
+		want := archived.ServiceAccounts[name]
+		current, ok := live.ServiceAccounts[name]
+		if !ok {
+			c.Create = true
+		} else {
+			c.Changes = appendChange(c.Changes, "parent", current.Parent, want.Parent)
+			c.Changes = appendChange(c.Changes, "status", current.Status, want.Status)
+			c.Changes = appendChange(c.Changes, "name", current.Name, want.Name)
+			c.Changes = appendChange(c.Changes, "description", current.Description, want.Description)
+			if !jsonEqual(want.SessionPolicy, current.SessionPolicy) {
+				c.Changes = append(c.Changes, "session policy differs")
+			}
+		}
+		out = append(out, c)
+	}
+
+	return out
+}
+
+func appendChange(changes []string, field, current, want string) []string {
+	if current == want {
+		return changes
+	}
+
+	return append(changes, fmt.Sprintf("%s: %q -> %q", field, current, want))
+}
+
+func appendListChange(changes []string, field string, current, want []string) []string {
+	current = slices.Sorted(slices.Values(current))
+	want = slices.Sorted(slices.Values(want))
+	if slices.Equal(current, want) {
+		return changes
+	}
+
+	return append(changes, fmt.Sprintf("%s: %v -> %v", field, current, want))
+}
+
+// jsonEqual reports whether two JSON documents are equal, ignoring formatting. Empty documents equal null.
+func jsonEqual(a, b []byte) bool {
+	var va, vb any
+	if len(bytes.TrimSpace(a)) > 0 {
+		if err := json.Unmarshal(a, &va); err != nil {
+			return false
+		}
+	}
+
+	if len(bytes.TrimSpace(b)) > 0 {
+		if err := json.Unmarshal(b, &vb); err != nil {
+			return false
+		}
+	}
+
+	ja, _ := json.Marshal(va)
+	jb, _ := json.Marshal(vb)
+
+	return bytes.Equal(ja, jb)
+}
+
+func isIAMNotFound(err error) bool {
+	return slices.Contains(iamNotFoundCodes, madmin.ToErrorResponse(err).Code)
+}
+
+// LiveIAM reads the selected entities from the instance. Entities which don't exist are left out.
+func (m *Minio) LiveIAM(ctx context.Context, sel IAMSelection) (IAMExport, error) {
+	out := IAMExport{
+		Policies:        map[string]json.RawMessage{},
+		Users:           map[string]IAMUser{},
+		Groups:          map[string]IAMGroup{},
+		ServiceAccounts: map[string]madmin.SRSvcAccCreate{},
+	}
+
+	for _, name := range sel.Policies {
+		info, err := m.adminClient.InfoCannedPolicyV2(ctx, name)
+		if isIAMNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return IAMExport{}, fmt.Errorf("get policy %s: %w", name, err)
+		}
+
+		out.Policies[name] = info.Policy
+	}
+
+	for _, name := range sel.Users {
+		info, err := m.adminClient.GetUserInfo(ctx, name)
+		if isIAMNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return IAMExport{}, fmt.Errorf("get user %s: %w", name, err)
+		}
+
+		out.Users[name] = IAMUser{Status: info.Status, Policies: splitList(info.PolicyName)}
+	}
+
+	for _, name := range sel.Groups {
+		desc, err := m.adminClient.GetGroupDescription(ctx, name)
+		if isIAMNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return IAMExport{}, fmt.Errorf("get group %s: %w", name, err)
+		}
+
+		out.Groups[name] = IAMGroup{Status: desc.Status, Members: desc.Members, Policies: splitList(desc.Policy)}
+	}
+
+	for _, name := range sel.ServiceAccounts {
+		info, err := m.adminClient.InfoServiceAccount(ctx, name)
+		if isIAMNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return IAMExport{}, fmt.Errorf("get service account %s: %w", name, err)
+		}
+
+		sa := madmin.SRSvcAccCreate{
+			Parent:      info.ParentUser,
+			AccessKey:   name,
+			Status:      serviceAccountStatus(info.AccountStatus),
+			Name:        info.Name,
+			Description: info.Description,
+			Expiration:  info.Expiration,
+		}
+		if !info.ImpliedPolicy {
+			sa.SessionPolicy = json.RawMessage(info.Policy)
+		}
+
+		out.ServiceAccounts[name] = sa
+	}
+
+	return out, nil
+}
+
+// RestoreIAM applies the changes, restoring the entities from the archive one by one.
+// Secret keys are only restored for entities which don't exist on the live instance.
+func (m *Minio) RestoreIAM(ctx context.Context, archived, live IAMExport, changes []IAMChange) error {
+	for _, c := range changes {
+		if c.Unchanged() {
+			continue
+		}
+
+		log := m.log.With("kind", c.Kind, "name", c.Name)
+		log.Info("restoring iam entity", "create", c.Create, "changes", strings.Join(c.Changes, "; "))
+
+		var err error
+		switch c.Kind {
+		case iamPolicy:
+			err = m.adminClient.AddCannedPolicy(ctx, c.Name, archived.Policies[c.Name])
+		case iamUser:
+			err = m.restoreUser(ctx, c, archived.Users[c.Name], live.Users[c.Name])
+		case iamGroup:
+			err = m.restoreGroup(ctx, c, archived.Groups[c.Name], live.Groups[c.Name])
+		case iamServiceAccount:
+			err = m.restoreServiceAccount(ctx, c, archived.ServiceAccounts[c.Name])
+		}
+		if err != nil {
+			return fmt.Errorf("restore %s %s: %w", c.Kind, c.Name, err)
+		}
+	}
+
+	return nil
+}
+
+func (m *Minio) restoreUser(ctx context.Context, c IAMChange, want, current IAMUser) error {
+	if c.Create {
+		err := m.adminClient.AddUser(ctx, c.Name, want.SecretKey)
+		if err != nil {
+			return err
+		}
+	}
+
+	if want.Status != "" && want.Status != current.Status {
+		err := m.adminClient.SetUserStatus(ctx, c.Name, want.Status)
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.restorePolicies(ctx, c.Name, false, want.Policies, current.Policies)
+}
+
+func (m *Minio) restoreGroup(ctx context.Context, c IAMChange, want, current IAMGroup) error {
+	// adding members creates the group if needed
+	err := m.adminClient.UpdateGroupMembers(ctx, madmin.GroupAddRemove{Group: c.Name, Members: want.Members})
+	if err != nil {
+		return err
+	}
+
+	var extra []string
+	for _, member := range current.Members {
+		if !slices.Contains(want.Members, member) {
+			extra = append(extra, member)
+		}
+	}
+
+	if len(extra) > 0 {
+		err = m.adminClient.UpdateGroupMembers(ctx, madmin.GroupAddRemove{Group: c.Name, Members: extra, IsRemove: true})
+		if err != nil {
+			return err
+		}
+	}
+
+	if want.Status != "" && want.Status != current.Status {
+		err = m.adminClient.SetGroupStatus(ctx, c.Name, madmin.GroupStatus(want.Status))
+		if err != nil {
+			return err
+		}
+	}
+
+	return m.restorePolicies(ctx, c.Name, true, want.Policies, current.Policies)
+}
+
+// restorePolicies replaces the policies attached to a user or group.
+func (m *Minio) restorePolicies(ctx context.Context, name string, group bool, want, current []string) error {
+	if len(want) > 0 {
+		return m.adminClient.SetPolicy(ctx, strings.Join(want, ","), name, group)
+	}
+
+	if len(current) == 0 {
+		return nil
+	}
+
+	req := madmin.PolicyAssociationReq{Policies: current, User: name}
+	if group {
+		req = madmin.PolicyAssociationReq{Policies: current, Group: name}
+	}
+
+	_, err := m.adminClient.DetachPolicy(ctx, req)
+	return err
+}
+
+func (m *Minio) restoreServiceAccount(ctx context.Context, c IAMChange, want madmin.SRSvcAccCreate) error {
+	expiration := want.Expiration
+	if expiration != nil && expiration.Before(time.Now()) {
+		m.log.Warn("service account expired, restoring without expiration", "name", c.Name, "expiration", expiration)
+		expiration = nil
+	}
+
+	if c.Create {
+		_, err := m.adminClient.AddServiceAccount(ctx, madmin.AddServiceAccountReq{
+			Policy:      want.SessionPolicy,
+			TargetUser:  want.Parent,
+			AccessKey:   want.AccessKey,
+			SecretKey:   want.SecretKey,
+			Name:        want.Name,
+			Description: want.Description,
+			Expiration:  expiration,
+		})
+		if err != nil {
+			return err
+		}
+
+		if want.Status == "" || want.Status == string(madmin.AccountEnabled) {
+			return nil
+		}
+	}
+
+	return m.adminClient.UpdateServiceAccount(ctx, c.Name, madmin.UpdateServiceAccountReq{
+		NewPolicy:      want.SessionPolicy,
+		NewStatus:      want.Status,
+		NewName:        want.Name,
+		NewDescription: want.Description,
+		NewExpiration:  expiration,
+	})
+}
+
+type MetaIAMRestoreOptions struct {
+	At     *string
+	Run    string
+	From   string
+	Select IAMSelection
+	// DryRun only prints the differences to the live instance.
+	DryRun bool
+}
+
+// MetaIAMRestore restores selected IAM entities from a metadata archive onto the source instance.
+// The differences to the live instance are printed before anything is changed.
+func MetaIAMRestore(ctx context.Context, opts MetaIAMRestoreOptions) {
+	config, err := Config()
+	if err != nil {
+		panic(err)
+	}
+
+	if err := config.ValidateSource(); err != nil {
+		panic(err)
+	}
+
+	if opts.Select.Empty() {
+		panic(fmt.Errorf("select at least one user, group, policy or service account to restore"))
+	}
+
+	l := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	file, err := downloadMeta(ctx, config, opts.At, opts.Run, opts.From, l.With("target", config.Crypt.Name))
+	if err != nil {
+		panic(err)
+	}
+
+	dir, err := os.MkdirTemp("", "s32s3-*")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archive, err := ReadMetaArchive(file, dir)
+	if err != nil {
+		panic(err)
+	}
+
+	if !archive.Has(fileIAM) {
+		panic(fmt.Errorf("metadata archive contains no iam export"))
+	}
+
+	data, err := os.ReadFile(filepath.Join(archive.Dir, fileIAM))
+	if err != nil {
+		panic(err)
+	}
+
+	archived, err := ParseIAMExport(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		panic(err)
+	}
+
+	sel, err := opts.Select.Resolve(archived)
+	if err != nil {
+		panic(err)
+	}
+
+	m, err := NewMinio(l.With("target", config.Source.Name), config.Source.Value)
+	if err != nil {
+		panic(err)
+	}
+
+	if _, ok := NewMetadataExporter(m).(MinioExporter); !ok {
+		panic(fmt.Errorf("iam can only be restored onto a MinIO source, the provider is %s", config.Source.Value.Provider))
+	}
+
+	live, err := m.LiveIAM(ctx, sel)
+	if err != nil {
+		panic(err)
+	}
+
+	changes := DiffIAM(archived, live, sel)
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+
+	if opts.DryRun {
+		return
+	}
+
+	err = m.RestoreIAM(ctx, archived, live, changes)
+	if err != nil {
+		panic(err)
+	}
+
+	l.Info("iam restore complete")
+}
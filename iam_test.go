@@ -0,0 +1,120 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"encoding/json"
+	"path"
+	"slices"
+	"testing"
+
+	"github.com/minio/madmin-go/v3"
+)
+
+func TestIAMExportDiff(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := zip.NewWriter(buf)
+	for name, data := range map[string]string{
+		iamPoliciesFile:           `{"readonly-logs": {"Version": "2012-10-17", "Statement": [{"Effect": "Allow", "Action": ["s3:GetObject"], "Resource": ["arn:aws:s3:::logs/*"]}]}}`,
+		iamUsersFile:              `{"alice": {"secretKey": "alice-secret", "status": "enabled"}, "bob": {"secretKey": "bob-secret", "status": "enabled"}}`,
+		iamGroupsFile:             `{"ops": {"name": "ops", "status": "enabled", "members": ["alice", "bob"]}}`,
+		iamUserPolicyMappingsFile: `{"alice": {"version": 1, "policy": "readonly-logs,diagnostics"}}`,
+	} {
+		f, err := w.Create(path.Join(iamAssetsDir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(data))
+	}
+	w.Close()
+
+	archived, err := ParseIAMExport(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if archived.Users["alice"].SecretKey != "alice-secret" || len(archived.ServiceAccounts) != 0 {
+		t.Errorf("unexpected export: %+v", archived)
+	}
+
+	_, err = IAMSelection{Users: []string{"carol"}}.Resolve(archived)
+	if err == nil {
+		t.Error("expected error for user missing from the archive")
+	}
+
+	sel, err := IAMSelection{Users: []string{"*"}, Groups: []string{"ops"}, Policies: []string{"readonly-logs"}}.Resolve(archived)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !slices.Equal(sel.Users, []string{"alice", "bob"}) {
+		t.Errorf("unexpected users: %v", sel.Users)
+	}
+
+	live := IAMExport{
+		Policies: map[string]json.RawMessage{
+			"readonly-logs": json.RawMessage(`{"Statement":[{"Action":["s3:GetObject"],"Effect":"Allow","Resource":["arn:aws:s3:::logs/*"]}],"Version":"2012-10-17"}`),
+		},
+		Users: map[string]IAMUser{
+			"alice": {Status: "enabled", Policies: []string{"readwrite"}},
+		},
+		Groups: map[string]IAMGroup{
+			"ops": {Status: "enabled", Members: []string{"bob", "alice"}},
+		},
+	}
+
+	var got []string
+	for _, c := range DiffIAM(archived, live, sel) {
+		got = append(got, c.String())
+	}
+
+	want := []string{
+		"unchanged\tpolicy\treadonly-logs\t",
+		"update\tuser\talice\tpolicies: [readwrite] -> [diagnostics readonly-logs]",
+		"create\tuser\tbob\t",
+		"unchanged\tgroup\tops\t",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected:\n%q\ngot:\n%q", want, got)
+	}
+}
+
+func TestIAMServiceAccountStatus(t *testing.T) {
+	buf := bytes.NewBuffer(nil)
+	w := zip.NewWriter(buf)
+	f, err := w.Create(path.Join(iamAssetsDir, iamServiceAccountsFile))
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"ci": {"parent": "alice", "accessKey": "ci", "status": "on"}, "old": {"parent": "alice", "accessKey": "old", "status": "off"}}`))
+	w.Close()
+
+	archived, err := ParseIAMExport(bytes.NewReader(buf.Bytes()), int64(buf.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if archived.ServiceAccounts["ci"].Status != "enabled" || archived.ServiceAccounts["old"].Status != "disabled" {
+		t.Errorf("expected normalized status, got %+v", archived.ServiceAccounts)
+	}
+
+	live := IAMExport{
+		ServiceAccounts: map[string]madmin.SRSvcAccCreate{
+			"ci":  {Parent: "alice", AccessKey: "ci", Status: serviceAccountStatus("on")},
+			"old": {Parent: "alice", AccessKey: "old", Status: serviceAccountStatus("on")},
+		},
+	}
+
+	var got []string
+	for _, c := range DiffIAM(archived, live, IAMSelection{ServiceAccounts: []string{"ci", "old"}}) {
+		got = append(got, c.String())
+	}
+
+	want := []string{
+		"unchanged\tservice-account\tci\t",
+		"update\tservice-account\told\tstatus: \"enabled\" -> \"disabled\"",
+	}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected:\n%q\ngot:\n%q", want, got)
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const (
+	// localMetaDir is the directory of a local restore the metadata is extracted into.
+	// It's not a valid bucket name, so it can't collide with restored buckets next to it.
+	localMetaDir = ".s32s3"
+	// bucketConfigDir is the directory below the metadata the readable bucket configuration is unpacked into.
+	bucketConfigDir = "bucket_config"
+	// fileRestoreSummary is the summary of a local restore, written next to the metadata.
+	fileRestoreSummary = "restore.json"
+)
+
+// ExtractMeta extracts and verifies the files of a metadata archive, as written by ExportMetadata, into dir.
+// The manifest is written next to them, including for version 1 archives which don't have one.
+// The readable bucket configuration is unpacked as well, into a directory per bucket.
+func ExtractMeta(meta string, dir string) error {
+	archive, err := ReadMetaArchive(meta, dir)
+	if err != nil {
+		return fmt.Errorf("read metadata archive: %w", err)
+	}
+
+	manifest, err := marshalManifest(archive.Manifest)
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+
+	err = writeFile(filepath.Join(dir, fileManifest), manifest)
+	if err != nil {
+		return err
+	}
+
+	if !archive.Has(fileBucketConfig) {
+		return nil
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, fileBucketConfig))
+	if err != nil {
+		return err
+	}
+
+	files, err := readZip(data)
+	if err != nil {
+		return fmt.Errorf("read %s: %w", fileBucketConfig, err)
+	}
+
+	for name, content := range files {
+		name = filepath.Clean(name)
+		if !filepath.IsLocal(name) {
+			return fmt.Errorf("invalid file name in %s: %s", fileBucketConfig, name)
+		}
+
+		err = writeFile(filepath.Join(dir, bucketConfigDir, name), bytes.NewReader(content))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func writeFile(name string, r io.Reader) error {
+	err := os.MkdirAll(filepath.Dir(name), 0o755)
+	if err != nil {
+		return err
+	}
+
+	f, err := os.Create(name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(f, r)
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
+
+// finishLocalRestore writes the summary of a local restore into the metadata directory of dir.
+// The partially restored data of failed buckets is removed if removeFailed is set,
+// so that only complete buckets end up in a tar archive.
+func finishLocalRestore(dir string, summary RestoreSummary, removeFailed bool) error {
+	if removeFailed {
+		for _, bucket := range summary.Failed() {
+			err := os.RemoveAll(filepath.Join(dir, bucket))
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	data, err := json.MarshalIndent(summary, "", "  ")
+	if err != nil {
+		return err
+	}
+
+	return writeFile(filepath.Join(dir, localMetaDir, fileRestoreSummary), bytes.NewReader(data))
+}
+
+// WriteTar writes the contents of dir into a tar archive at file.
+func WriteTar(dir string, file string) error {
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+
+	archive := tar.NewWriter(f)
+	err = filepath.WalkDir(dir, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(dir, p)
+		if err != nil {
+			return err
+		}
+
+		if rel == "." {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+
+		header.Name = filepath.ToSlash(rel)
+		if d.IsDir() && !strings.HasSuffix(header.Name, "/") {
+			header.Name += "/"
+		}
+
+		err = archive.WriteHeader(header)
+		if err != nil {
+			return err
+		}
+
+		if !d.Type().IsRegular() {
+			return nil
+		}
+
+		src, err := os.Open(p)
+		if err != nil {
+			return err
+		}
+		defer src.Close()
+
+		_, err = io.Copy(archive, src)
+		return err
+	})
+	if err != nil {
+		f.Close()
+		return err
+	}
+
+	if err := archive.Close(); err != nil {
+		f.Close()
+		return err
+	}
+
+	return f.Close()
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"archive/tar"
+	"encoding/json"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+)
+
+func TestExtractMetaBucketConfig(t *testing.T) {
+	config := writeZip(t, map[string]string{
+		"logs/policy.json":    `{"Version": "2012-10-17"}`,
+		"logs/versioning.xml": `<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>`,
+	})
+	file := writeRawArchive(t, rawEntry{name: fileBucketConfig, data: config})
+
+	dir := t.TempDir()
+	if err := ExtractMeta(file, dir); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(dir, bucketConfigDir, "logs", "policy.json"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != `{"Version": "2012-10-17"}` {
+		t.Errorf("unexpected policy: %s", data)
+	}
+}
+
+func TestWriteTarPartialRestore(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"logs/a.txt", "media/b.txt"} {
+		if err := writeFile(filepath.Join(dir, name), strings.NewReader(name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	summary := RestoreSummary{Buckets: []BucketRun{{Name: "logs"}, {Name: "media", Error: "exit status 5"}}}
+	if err := finishLocalRestore(dir, summary, true); err != nil {
+		t.Fatal(err)
+	}
+
+	file := filepath.Join(t.TempDir(), "restore.tar")
+	if err := WriteTar(dir, file); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+
+	var names []string
+	var written RestoreSummary
+	r := tar.NewReader(f)
+	for {
+		header, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		names = append(names, header.Name)
+		if header.Name == localMetaDir+"/"+fileRestoreSummary {
+			if err := json.NewDecoder(r).Decode(&written); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	slices.Sort(names)
+	want := []string{".s32s3/", ".s32s3/restore.json", "logs/", "logs/a.txt"}
+	if !slices.Equal(names, want) {
+		t.Errorf("expected %v, got %v", want, names)
+	}
+
+	if !slices.Equal(written.Failed(), []string{"media"}) {
+		t.Errorf("expected media to be listed as failed, got %+v", written)
+	}
+}
@@ -2,12 +2,19 @@ package main
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"log/slog"
 	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
 
 	"github.com/sourcegraph/conc/iter"
 	"github.com/urfave/cli/v3"
+	"go.opentelemetry.io/otel/attribute"
 )
 
 func main() {
@@ -16,8 +23,21 @@ func main() {
 			Name:  "backup",
 			Usage: "backup all buckets and instance metadata",
 			Action: func(ctx context.Context, c *cli.Command) error {
-				Backup(ctx)
-				return nil
+				config, err := Config()
+				if err != nil {
+					return err
+				}
+
+				shutdown, err := SetupTracing(ctx, config.Tracing)
+				if err != nil {
+					return err
+				}
+				defer shutdown(context.WithoutCancel(ctx))
+
+				_, err = Backup(ctx, config, BackupOptions{
+					log: slog.New(slog.NewTextHandler(os.Stdout, nil)),
+				})
+				return err
 			},
 		},
 		{
@@ -28,6 +48,129 @@ func main() {
 					Name:  "at",
 					Usage: "restore at specific time",
 				},
+				&cli.StringFlag{
+					Name:  "run",
+					Usage: "restore the snapshot of a backup run, see the runs command",
+				},
+				&cli.StringFlag{
+					Name:  "meta-from",
+					Usage: "restore the metadata archive with this ID instead of the one matching the restored data, see meta list",
+				},
+				&cli.StringFlag{
+					Name:  "meta",
+					Usage: "comma separated parts of the metadata to restore: iam, buckets, config",
+					Value: "iam,buckets,config",
+				},
+				&cli.BoolFlag{
+					Name:  "no-meta",
+					Usage: "don't restore any metadata",
+				},
+				&cli.StringFlag{
+					Name:  "config-include",
+					Usage: "comma separated config subsystems to restore, globs are allowed",
+				},
+				&cli.StringFlag{
+					Name:  "config-exclude",
+					Usage: "comma separated config subsystems not to restore, globs are allowed",
+				},
+				&cli.StringSliceFlag{
+					Name:  "config-set",
+					Usage: "rewrite config keys before restoring, as `subsys[:target] key=value`",
+				},
+				&cli.StringFlag{
+					Name:  "to-dir",
+					Usage: "restore into a local directory instead of the source instance",
+				},
+				&cli.StringFlag{
+					Name:  "to-tar",
+					Usage: "restore into a local tar archive instead of the source instance",
+				},
+				&cli.StringSliceFlag{
+					Name:  "bucket",
+					Usage: "restore only this bucket, globs are allowed, can be repeated",
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				atflag := c.String("at")
+				var at *string
+				if atflag != "" {
+					at = &atflag
+				}
+
+				meta, err := ParseRestoreMetaOptions(c.String("meta"))
+				if err != nil {
+					return err
+				}
+				meta.ConfigFilter = configFilterFlags(c)
+
+				if c.Bool("no-meta") {
+					meta = RestoreMetaOptions{}
+				}
+
+				config, err := Config()
+				if err != nil {
+					return err
+				}
+
+				shutdown, err := SetupTracing(ctx, config.Tracing)
+				if err != nil {
+					return err
+				}
+				defer shutdown(context.WithoutCancel(ctx))
+
+				summary, err := Restore(ctx, config, RestoreOptions{
+					Meta:     meta,
+					At:       at,
+					Run:      c.String("run"),
+					ToDir:    c.String("to-dir"),
+					ToTar:    c.String("to-tar"),
+					MetaFrom: c.String("meta-from"),
+					Buckets:  c.StringSlice("bucket"),
+					log:      slog.New(slog.NewTextHandler(os.Stdout, nil)),
+				})
+				if err != nil {
+					return err
+				}
+
+				if failed := summary.Failed(); len(failed) > 0 {
+					return fmt.Errorf("failed to restore buckets: %s", strings.Join(failed, ", "))
+				}
+
+				return nil
+			},
+		},
+		{
+			Name:  "serve",
+			Usage: "serve an HTTP API to watch, start and cancel backups and restores",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "listen",
+					Usage: "address to listen on",
+					Value: ":8080",
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				return Serve(ctx, c.String("listen"))
+			},
+		},
+		{
+			Name:      "ls",
+			Usage:     "list the contents of a backed up bucket",
+			ArgsUsage: "bucket[/prefix]",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "at",
+					Usage: "list at specific time",
+				},
+				&cli.StringFlag{
+					Name:  "run",
+					Usage: "list the snapshot of a backup run",
+				},
+				&cli.BoolFlag{
+					Name:    "recursive",
+					Aliases: []string{"R"},
+					Usage:   "list recursively",
+				},
 			},
 			Action: func(ctx context.Context, c *cli.Command) error {
 				atflag := c.String("at")
@@ -36,10 +179,234 @@ func main() {
 					at = &atflag
 				}
 
-				Restore(ctx, at)
+				Ls(ctx, c.Args().First(), at, c.String("run"), c.Bool("recursive"))
 				return nil
 			},
 		},
+		{
+			Name:      "get",
+			Usage:     "download an object or a prefix from a backed up bucket",
+			ArgsUsage: "bucket/key",
+			Flags: []cli.Flag{
+				&cli.StringFlag{
+					Name:  "at",
+					Usage: "download at specific time",
+				},
+				&cli.StringFlag{
+					Name:  "run",
+					Usage: "download from the snapshot of a backup run",
+				},
+				&cli.StringFlag{
+					Name:    "output",
+					Aliases: []string{"o"},
+					Usage:   "file or directory to write to, - for stdout. Defaults to the base name of the key",
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				atflag := c.String("at")
+				var at *string
+				if atflag != "" {
+					at = &atflag
+				}
+
+				Get(ctx, c.Args().First(), at, c.String("run"), c.String("output"))
+				return nil
+			},
+		},
+		{
+			Name:  "runs",
+			Usage: "list backup runs",
+			Action: func(ctx context.Context, c *cli.Command) error {
+				Runs(ctx)
+				return nil
+			},
+		},
+		{
+			Name:  "prune",
+			Usage: "delete backup data not needed by any snapshot kept by the retention policy",
+			Flags: []cli.Flag{
+				&cli.BoolFlag{
+					Name:  "dry-run",
+					Usage: "only show what would be deleted",
+				},
+			},
+			Action: func(ctx context.Context, c *cli.Command) error {
+				Prune(ctx, c.Bool("dry-run"))
+				return nil
+			},
+		},
+		{
+			Name:  "meta",
+			Usage: "manage instance metadata backups",
+			Commands: []*cli.Command{
+				{
+					Name:  "list",
+					Usage: "list metadata archives",
+					Action: func(ctx context.Context, c *cli.Command) error {
+						MetaList(ctx)
+						return nil
+					},
+				},
+				{
+					Name:  "restore",
+					Usage: "restore instance metadata without restoring data",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "at",
+							Usage: "restore the newest metadata archive at specific time",
+						},
+						&cli.StringFlag{
+							Name:  "run",
+							Usage: "restore the metadata archive of a backup run",
+						},
+						&cli.StringFlag{
+							Name:  "from",
+							Usage: "restore the metadata archive with this ID, see meta list",
+						},
+						&cli.StringFlag{
+							Name:  "meta",
+							Usage: "comma separated parts of the metadata to restore: iam, buckets, config",
+							Value: "iam,buckets,config",
+						},
+						&cli.StringFlag{
+							Name:  "config-include",
+							Usage: "comma separated config subsystems to restore, globs are allowed",
+						},
+						&cli.StringFlag{
+							Name:  "config-exclude",
+							Usage: "comma separated config subsystems not to restore, globs are allowed",
+						},
+						&cli.StringSliceFlag{
+							Name:  "config-set",
+							Usage: "rewrite config keys before restoring, as `subsys[:target] key=value`",
+						},
+					},
+					Action: func(ctx context.Context, c *cli.Command) error {
+						atflag := c.String("at")
+						var at *string
+						if atflag != "" {
+							at = &atflag
+						}
+
+						meta, err := ParseRestoreMetaOptions(c.String("meta"))
+						if err != nil {
+							return err
+						}
+						meta.ConfigFilter = configFilterFlags(c)
+
+						MetaRestore(ctx, MetaRestoreOptions{
+							At:   at,
+							Run:  c.String("run"),
+							From: c.String("from"),
+							Meta: meta,
+						})
+						return nil
+					},
+				},
+				{
+					Name:  "diff",
+					Usage: "compare archived metadata with the live source instance",
+					Flags: []cli.Flag{
+						&cli.StringFlag{
+							Name:  "at",
+							Usage: "compare the newest metadata archive at specific time",
+						},
+						&cli.StringFlag{
+							Name:  "run",
+							Usage: "compare the metadata archive of a backup run",
+						},
+						&cli.StringFlag{
+							Name:  "from",
+							Usage: "compare the metadata archive with this ID, see meta list",
+						},
+						&cli.StringFlag{
+							Name:  "to",
+							Usage: "compare with the metadata archive with this ID instead of the live instance",
+						},
+					},
+					Action: func(ctx context.Context, c *cli.Command) error {
+						atflag := c.String("at")
+						var at *string
+						if atflag != "" {
+							at = &atflag
+						}
+
+						MetaDiff(ctx, MetaDiffOptions{
+							At:   at,
+							Run:  c.String("run"),
+							From: c.String("from"),
+							To:   c.String("to"),
+						})
+						return nil
+					},
+				},
+				{
+					Name:  "iam",
+					Usage: "manage the iam export of metadata backups",
+					Commands: []*cli.Command{
+						{
+							Name:  "restore",
+							Usage: "restore selected users, groups, policies and service accounts",
+							Flags: []cli.Flag{
+								&cli.StringFlag{
+									Name:  "at",
+									Usage: "restore from the newest metadata archive at specific time",
+								},
+								&cli.StringFlag{
+									Name:  "run",
+									Usage: "restore from the metadata archive of a backup run",
+								},
+								&cli.StringFlag{
+									Name:  "from",
+									Usage: "restore from the metadata archive with this ID, see meta list",
+								},
+								&cli.StringSliceFlag{
+									Name:  "user",
+									Usage: "restore a user, globs are allowed",
+								},
+								&cli.StringSliceFlag{
+									Name:  "group",
+									Usage: "restore a group, globs are allowed",
+								},
+								&cli.StringSliceFlag{
+									Name:  "policy",
+									Usage: "restore a policy, globs are allowed",
+								},
+								&cli.StringSliceFlag{
+									Name:  "service-account",
+									Usage: "restore a service account by access key, globs are allowed",
+								},
+								&cli.BoolFlag{
+									Name:  "dry-run",
+									Usage: "only show the differences to the live instance",
+								},
+							},
+							Action: func(ctx context.Context, c *cli.Command) error {
+								atflag := c.String("at")
+								var at *string
+								if atflag != "" {
+									at = &atflag
+								}
+
+								MetaIAMRestore(ctx, MetaIAMRestoreOptions{
+									At:   at,
+									Run:  c.String("run"),
+									From: c.String("from"),
+									Select: IAMSelection{
+										Users:           c.StringSlice("user"),
+										Groups:          c.StringSlice("group"),
+										Policies:        c.StringSlice("policy"),
+										ServiceAccounts: c.StringSlice("service-account"),
+									},
+									DryRun: c.Bool("dry-run"),
+								})
+								return nil
+							},
+						},
+					},
+				},
+			},
+		},
 		{
 			Name:  "rclone-config",
 			Usage: "show rclone config",
@@ -71,62 +438,260 @@ func main() {
 	}
 }
 
-func Restore(ctx context.Context, at *string) {
-	config, err := Config()
+// configFilterFlags returns the config filter set by the config-* flags of a restore command.
+func configFilterFlags(c *cli.Command) ConfigFilter {
+	return ConfigFilter{
+		Include: c.String("config-include"),
+		Exclude: c.String("config-exclude"),
+		Set:     strings.Join(c.StringSlice("config-set"), "\n"),
+	}
+}
+
+type RestoreOptions struct {
+	At  *string
+	Run string
+	// ToDir restores into a local directory instead of the source instance.
+	ToDir string
+	// ToTar restores into a local tar archive instead of the source instance.
+	ToTar string
+	// MetaFrom is the ID of the metadata archive to restore, see the meta list command.
+	// By default the archive of the restored run is used.
+	MetaFrom string
+	// Meta selects the parts of the metadata to restore.
+	Meta RestoreMetaOptions
+	// Buckets selects the buckets to restore by name or glob, all are restored if empty.
+	Buckets []string
+	// Progress tracks the progress of the restore, if set.
+	Progress *Progress
+	log      *slog.Logger
+}
+
+// RestoreSummary is the outcome of a restore.
+type RestoreSummary struct {
+	StartedAt  time.Time   `json:"startedAt"`
+	FinishedAt time.Time   `json:"finishedAt"`
+	At         *string     `json:"at,omitempty"`
+	Run        string      `json:"run,omitempty"`
+	Buckets    []BucketRun `json:"buckets"`
+}
+
+// Failed returns the names of the buckets that failed to restore.
+func (s RestoreSummary) Failed() []string {
+	return failedBuckets(s.Buckets)
+}
+
+// selectBuckets returns the buckets matching any of the names or globs, or all if there are none.
+func selectBuckets(patterns []string, buckets []string) ([]string, error) {
+	if len(patterns) == 0 {
+		return buckets, nil
+	}
+
+	var out []string
+	for _, p := range patterns {
+		if _, err := path.Match(p, ""); err != nil {
+			return nil, fmt.Errorf("invalid bucket glob %q: %w", p, err)
+		}
+
+		found := false
+		for _, bucket := range buckets {
+			if ok, _ := path.Match(p, bucket); ok {
+				found = true
+				if !slices.Contains(out, bucket) {
+					out = append(out, bucket)
+				}
+			}
+		}
+
+		if !found {
+			return nil, fmt.Errorf("bucket %q not found in backup", p)
+		}
+	}
+
+	return out, nil
+}
+
+// Restore restores the backup selected by opts, into the source instance or a local directory or archive.
+// Buckets failing to restore are reported in the summary, while other failures abort the restore with an error.
+// The outcome is posted to the configured webhooks.
+func Restore(ctx context.Context, config BackupConfig, opts RestoreOptions) (RestoreSummary, error) {
+	ctx, span := tracer.Start(ctx, "restore")
+	summary, err := restore(ctx, config, opts)
+	endRunSpan(span, summary.Run, summary.Buckets, err)
+	notify(ctx, config, NewNotification(operationRestore, summary.Run, summary.StartedAt, summary.Buckets, err), opts.log)
+	return summary, err
+}
+
+func restore(ctx context.Context, config BackupConfig, opts RestoreOptions) (RestoreSummary, error) {
+	summary := RestoreSummary{StartedAt: time.Now().UTC(), Run: opts.Run}
+	if opts.ToDir != "" && opts.ToTar != "" {
+		return summary, fmt.Errorf("--to-dir and --to-tar are mutually exclusive")
+	}
+
+	local := opts.ToDir != "" || opts.ToTar != ""
+	if !local {
+		if err := config.ValidateSource(); err != nil {
+			return summary, err
+		}
+	}
+
+	l := opts.log
+	at, run, err := resolveAt(ctx, config, opts.At, opts.Run, l.With("target", config.Crypt.Name))
 	if err != nil {
-		panic(err)
+		return summary, err
 	}
+	summary.At = at
 
-	l := slog.New(slog.NewTextHandler(os.Stdout, nil))
-	// first restore meta
-	file, err := RcloneDownloadFile(ctx, config, DownloadFileOptions{
-		File:   SourceMetadata,
-		Source: config.Crypt.Name,
-		At:     at,
-		log:    l.With("target", config.Crypt.Name),
+	if run != nil {
+		for _, b := range run.Buckets {
+			if b.Filter != nil {
+				l.Warn("bucket was backed up with an object filter, objects not matching it are missing from the backup", "bucket", b.Name, "filter", strings.Join(b.Filter.Args(), " "))
+			}
+		}
+	}
+
+	opts.Meta.ConfigFilter = config.RestoreConfig.Merge(opts.Meta.ConfigFilter)
+
+	// metadata is chosen independently from data if requested, and otherwise matches it
+	metaID := opts.MetaFrom
+	if metaID == "" && run != nil {
+		metaID = run.Metadata
+	}
+
+	dir := opts.ToDir
+	if opts.ToTar != "" {
+		// stage next to the archive, so that it ends up on the same filesystem
+		dir, err = os.MkdirTemp(filepath.Dir(opts.ToTar), ".s32s3-restore-*")
+		if err != nil {
+			return summary, err
+		}
+		defer os.RemoveAll(dir)
+	}
+
+	buckets, err := traced(ctx, "list buckets", func(ctx context.Context) ([]string, error) {
+		return RcloneListBucketsRemote(ctx, config, ListBucketsOptions{
+			Remote: config.Crypt.Name,
+			At:     at,
+			log:    l.With("target", config.Crypt.Name),
+		})
 	})
 	if err != nil {
-		panic(err)
+		return summary, err
 	}
 
-	m, err := NewMinio(l, config.Source.Value)
+	// the selection is resolved before restoring metadata, so that a bucket missing from the backup fails the restore
+	// before anything is restored, and only the metadata of the selected buckets is restored.
+	buckets, err = selectBuckets(opts.Buckets, buckets)
 	if err != nil {
-		panic(err)
+		return summary, err
 	}
-	err = m.RestoreMeta(ctx, file)
-	if err != nil {
-		panic(err)
+	if len(opts.Buckets) > 0 {
+		opts.Meta.OnlyBuckets = buckets
 	}
 
-	buckets, err := RcloneListBucketsRemote(ctx, config, ListBucketsOptions{
-		Remote: config.Crypt.Name,
-		At:     at,
-		log:    l.With("target", config.Crypt.Name),
-	})
-	if err != nil {
-		panic(err)
+	// first restore meta
+	if opts.Meta.Any() {
+		file, err := RcloneDownloadMeta(ctx, config, DownloadMetaOptions{
+			ID:  metaID,
+			At:  at,
+			log: l.With("target", config.Crypt.Name),
+		})
+		if err != nil {
+			return summary, err
+		}
+
+		if local {
+			err = ExtractMeta(file, filepath.Join(dir, localMetaDir))
+			if err != nil {
+				return summary, err
+			}
+		} else {
+			m, err := NewMinio(l, config.Source.Value)
+			if err != nil {
+				return summary, err
+			}
+			err = RestoreMetadata(ctx, NewMetadataExporter(m), file, opts.Meta, l)
+			if err != nil {
+				return summary, err
+			}
+		}
+	} else {
+		l.Info("skipping metadata restore")
 	}
 
-	var errored bool
-	iter.ForEach(buckets, func(bucket *string) {
+	progress := opts.Progress
+	if progress == nil {
+		progress = NewProgress()
+	}
+	progress.Begin(summary.StartedAt, len(buckets))
+
+	concurrency := bucketConcurrency(len(buckets))
+	summary.Buckets = iter.Mapper[string, BucketRun]{MaxGoroutines: concurrency}.Map(buckets, traceBucket(ctx, "restore bucket", progress, func(ctx context.Context, bucket *string) BucketRun {
+		result := BucketRun{Name: *bucket}
+		if local {
+			l := l.With("bucket", *bucket).With("source", config.Crypt.Name).With("dest", dir)
+			l.Info("restoring bucket")
+			attempts, err := config.Retry.Do(ctx, l, func() error {
+				return RcloneCopy(ctx, config, CopyOptions{
+					Path:        *bucket,
+					Source:      config.Crypt.Name,
+					Dest:        filepath.Join(dir, *bucket),
+					At:          at,
+					Concurrency: concurrency,
+					log:         l,
+				})
+			})
+			result.Attempts = attempts
+			if err != nil {
+				l.Error("failed to restore bucket", "err", err)
+				result.Error = err.Error()
+			}
+
+			return result
+		}
+
 		l := l.With("bucket", *bucket).With("source", config.Crypt.Name).With("dest", config.Source.Name)
 		l.Info("restoring bucket")
-		err := RcloneSyncBucket(ctx, config, SyncBucketOptions{
-			Bucket: *bucket,
-			Source: config.Crypt.Name,
-			Dest:   config.Source.Name,
-			At:     at,
-			log:    l,
+		attempts, err := config.Retry.Do(ctx, l, func() error {
+			return RcloneSyncBucket(ctx, config, SyncBucketOptions{
+				Bucket:      *bucket,
+				Source:      config.Crypt.Name,
+				Dest:        config.Source.Name,
+				At:          at,
+				Concurrency: concurrency,
+				Stats: func(stats rcloneStats) {
+					progress.Update(*bucket, stats)
+				},
+				log: l,
+			})
 		})
+		result.Attempts = attempts
 		if err != nil {
 			l.Error("failed to restore bucket", "err", err)
-			errored = true
+			result.Error = err.Error()
 		}
-	})
 
-	if errored {
-		os.Exit(1)
+		return result
+	}))
+	summary.FinishedAt = time.Now().UTC()
+
+	if local {
+		err = finishLocalRestore(dir, summary, opts.ToTar != "")
+		if err != nil {
+			return summary, err
+		}
 	}
+
+	// buckets which failed are left out of the archive, and listed in its summary
+	if opts.ToTar != "" {
+		l.Info("writing tar archive", "file", opts.ToTar, "failed", summary.Failed())
+		err = WriteTar(dir, opts.ToTar)
+		if err != nil {
+			return summary, err
+		}
+	}
+
+	l.Info("restore complete", "finished", summary.FinishedAt, "failed", summary.Failed())
+	return summary, nil
 }
 
 func RcloneConfig(ctx context.Context) {
@@ -144,13 +709,17 @@ func MinioConfig(ctx context.Context) {
 		panic(err)
 	}
 
+	if err := config.ValidateSource(); err != nil {
+		panic(err)
+	}
+
 	l := slog.New(slog.NewTextHandler(os.Stdout, nil))
 	src, err := NewMinio(l.With("target", config.Source.Name), config.Source.Value)
 	if err != nil {
 		panic(err)
 	}
 
-	path, err := src.SourceMetadata(ctx)
+	path, err := ExportMetadata(ctx, NewMetadataExporter(src))
 	if err != nil {
 		panic(err)
 	}
@@ -158,59 +727,386 @@ func MinioConfig(ctx context.Context) {
 	fmt.Println(path)
 }
 
-func Backup(ctx context.Context) {
-	config, err := Config()
+type BackupOptions struct {
+	// Progress tracks the progress of the run, if set.
+	Progress *Progress
+	log      *slog.Logger
+}
+
+// Backup backs up the metadata and buckets of the source, and returns the record of the run.
+// Buckets failing to back up are reported in the run, while other failures abort the run with an error.
+// The outcome is posted to the configured webhooks.
+func Backup(ctx context.Context, config BackupConfig, opts BackupOptions) (Run, error) {
+	startedAt := time.Now()
+	ctx, span := tracer.Start(ctx, "backup")
+	run, err := backup(ctx, config, opts)
+	endRunSpan(span, run.ID, run.Buckets, err)
+	notify(ctx, config, NewNotification(operationBackup, run.ID, startedAt, run.Buckets, err), opts.log)
+	return run, err
+}
+
+func backup(ctx context.Context, config BackupConfig, opts BackupOptions) (Run, error) {
+	if err := config.ValidateSource(); err != nil {
+		return Run{}, err
+	}
+
+	if _, err := config.Buckets.Compile(); err != nil {
+		return Run{}, fmt.Errorf("bucket filter: %w", err)
+	}
+
+	filters, err := ParseObjectFilters(config.ObjectFilters)
 	if err != nil {
-		panic(err)
+		return Run{}, err
 	}
 
-	l := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	if err := validateBackupMode(config.BackupMode); err != nil {
+		return Run{}, err
+	}
+
+	l := opts.log
 	src, err := NewMinio(l.With("target", config.Source.Name), config.Source.Value)
 	if err != nil {
-		panic(err)
+		return Run{}, err
 	}
 
 	dest, err := NewMinio(l.With("target", config.Dest.Name), config.Dest.Value)
 	if err != nil {
-		panic(err)
+		return Run{}, err
+	}
+
+	// with a retention policy, old versions are pruned by snapshot instead of by age,
+	// unless expiration days are explicitly configured as well.
+	expirationDays := config.ExpirationDays
+	if config.Retention.Enabled() && expirationDays == 0 {
+		expirationDays = -1
 	}
 
+	run := NewRun(time.Now())
+	l = l.With("run", run.ID)
 	err = dest.AssertOrCreateBucket(ctx, BackupBucketOptions{
 		Bucket:         config.BackupBucket,
-		ExpirationDays: config.ExpirationDays,
+		ExpirationDays: expirationDays,
 	})
 	if err != nil {
-		panic(err)
+		return run, err
 	}
 
-	metapath, err := src.SourceMetadata(ctx)
+	metapath, err := traced(ctx, "export metadata", func(ctx context.Context) (string, error) {
+		return ExportMetadata(ctx, NewMetadataExporter(src))
+	})
 	if err != nil {
-		panic(err)
+		return run, err
 	}
 
-	RcloneSyncFile(ctx, config, SyncFileOptions{
+	// unchanged metadata isn't uploaded again, the run refers to the previous archive instead
+	unchanged, err := RcloneUnchangedMeta(ctx, config, UnchangedMetaOptions{
 		File: metapath,
-		Dest: config.Crypt.Name,
 		log:  l,
 	})
+	if err != nil {
+		l.Warn("failed to compare metadata with latest archive, uploading", "err", err)
+		unchanged = ""
+	}
 
-	buckets, err := src.ListBuckets(ctx)
+	if unchanged != "" {
+		l.Info("metadata unchanged, skipping upload", "metadata", unchanged)
+		os.Remove(metapath)
+		run.Metadata = unchanged
+	} else {
+		err = RcloneUploadMeta(ctx, config, UploadMetaOptions{
+			File: metapath,
+			ID:   run.ID,
+			log:  l,
+		})
+		if err != nil {
+			return run, err
+		}
+		run.Metadata = run.ID
+	}
+
+	listCtx, span := tracer.Start(ctx, "list buckets")
+	buckets, skipped, err := src.SelectBuckets(listCtx, config)
+	span.SetAttributes(attribute.Int("s32s3.buckets", len(buckets)), attribute.Int("s32s3.skipped", len(skipped)))
+	endSpan(span, err)
 	if err != nil {
-		panic(err)
+		return run, err
+	}
+	run.Skipped = skipped
+
+	// versioned buckets are synced as of the start of the run, so that the run is a consistent image
+	// across all buckets, no matter how long it takes.
+	startedAt := run.StartedAt.Format(time.RFC3339)
+	progress := opts.Progress
+	if progress == nil {
+		progress = NewProgress()
+	}
+	progress.Begin(run.StartedAt, len(buckets))
+	progressCtx, stopProgress := context.WithCancel(ctx)
+	if interval, _ := time.ParseDuration(config.Progress.Interval); interval > 0 {
+		go progress.Report(progressCtx, l, interval)
+	}
+	if config.Progress.Listen != "" {
+		go ServeProgress(progressCtx, config.Progress.Listen, progress, l)
 	}
 
-	iter.ForEach(buckets, func(bucket *string) {
+	concurrency := bucketConcurrency(len(buckets))
+	run.Buckets = iter.Mapper[string, BucketRun]{MaxGoroutines: concurrency}.Map(buckets, traceBucket(ctx, "backup bucket", progress, func(ctx context.Context, bucket *string) BucketRun {
 		l := l.With("bucket", *bucket).With("source", config.Source.Name).With("dest", config.Crypt.Name)
-		l.Info("backing up bucket")
-		err := RcloneSyncBucket(ctx, config, SyncBucketOptions{
-			Bucket: *bucket,
-			Source: config.Source.Name,
-			Dest:   config.Crypt.Name,
-			log:    l,
+		result := BucketRun{Name: *bucket}
+		versioned, err := src.VersioningEnabled(ctx, *bucket)
+		if err != nil {
+			l.Error("failed to get bucket versioning", "err", err)
+			result.Error = err.Error()
+			return result
+		}
+
+		opts := SyncBucketOptions{
+			Bucket:      *bucket,
+			Source:      config.Source.Name,
+			Dest:        config.Crypt.Name,
+			Filter:      filters.For(*bucket),
+			Copy:        config.BackupMode == backupModeCopy,
+			Concurrency: concurrency,
+			Stats: func(stats rcloneStats) {
+				progress.Update(*bucket, stats)
+			},
+			log: l,
+		}
+		result.Filter = opts.Filter
+		if versioned {
+			opts.SourceAt = &startedAt
+			result.PointInTime = true
+		} else {
+			l.Warn("bucket is not versioned, backup is not point in time")
+		}
+
+		// the planned deletions are checked before syncing, and rclone enforces the same limit while syncing
+		// in case the source changed in between.
+		total := 0
+		if !opts.Copy && config.DeleteGuard.Enabled() {
+			var deletes int
+			deletes, total, err = RclonePlannedDeletes(ctx, config, PlannedDeletesOptions{
+				Bucket:   *bucket,
+				Source:   opts.Source,
+				Dest:     opts.Dest,
+				SourceAt: opts.SourceAt,
+				Filter:   opts.Filter,
+				log:      l,
+			})
+			if err != nil {
+				l.Error("failed to plan deletions", "err", err)
+				result.Error = err.Error()
+				return result
+			}
+
+			if err := config.DeleteGuard.Check(deletes, total); err != nil {
+				l.Error("mass deletion prevented, bucket not backed up", "err", err)
+				result.Error = err.Error()
+				result.MassDeletion = true
+				return result
+			}
+
+			limit := config.DeleteGuard.Limit(total)
+			opts.MaxDelete = &limit
+		}
+
+		l.Info("backing up bucket", "at", opts.SourceAt)
+		result.Attempts, err = config.Retry.Do(ctx, l, func() error {
+			return RcloneSyncBucket(ctx, config, opts)
 		})
+		if opts.MaxDelete != nil {
+			err = maxDeleteError(err, *opts.MaxDelete, total)
+		}
+		var massErr *MassDeletionError
+		if errors.As(err, &massErr) {
+			l.Error("mass deletion prevented while syncing, bucket partially backed up", "err", err)
+			result.Error = err.Error()
+			result.MassDeletion = true
+			return result
+		}
 		if err != nil {
 			l.Error("failed to backup bucket", "err", err)
-			return
+			result.Error = err.Error()
+			return result
+		}
+
+		if opts.Copy {
+			result.Tombstones, result.Deleted, err = RcloneExpireDeleted(ctx, config, ExpireDeletedOptions{
+				Bucket:   *bucket,
+				Source:   config.Source.Name,
+				SourceAt: opts.SourceAt,
+				Dest:     config.Crypt.Name,
+				Filter:   opts.Filter,
+				Grace:    time.Duration(config.DeletionGraceDays) * 24 * time.Hour,
+				Guard:    config.DeleteGuard,
+				Now:      run.StartedAt,
+				log:      l,
+			})
+			var massErr *MassDeletionError
+			if errors.As(err, &massErr) {
+				l.Error("mass deletion prevented, objects past their grace period kept", "err", err)
+				result.MassDeletion = true
+			} else if err != nil {
+				l.Error("failed to expire deleted objects", "err", err)
+			}
+			if err != nil {
+				result.Error = err.Error()
+			}
 		}
+
+		return result
+	}))
+	stopProgress()
+
+	run.FinishedAt = time.Now().UTC()
+	err = RcloneWriteRun(ctx, config, WriteRunOptions{
+		Run: run,
+		log: l,
 	})
+	if err != nil {
+		return run, err
+	}
+
+	if massDeletions := run.MassDeletions(); len(massDeletions) > 0 {
+		l.Error("mass deletion prevented in buckets, check the sources or raise MAX_DELETE_PERCENT and MAX_DELETE_COUNT", "buckets", massDeletions)
+	}
+
+	total := progress.Snapshot()
+	l.Info("backup complete", "finished", run.FinishedAt, "failed", run.Failed(), "bytes", total.Bytes, "objects", total.Objects)
+	return run, nil
+}
+
+func Runs(ctx context.Context) {
+	config, err := Config()
+	if err != nil {
+		panic(err)
+	}
+
+	l := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	runs, err := RcloneListRuns(ctx, config, ListRunsOptions{
+		log: l.With("target", config.Crypt.Name),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	keep := config.Retention.Apply(runs)
+	for _, run := range runs {
+		fmt.Printf("%s\t%s\t%s\t%d buckets\t%d failed\t%s\n",
+			run.ID,
+			run.StartedAt.Format(time.RFC3339),
+			run.FinishedAt.Format(time.RFC3339),
+			len(run.Buckets),
+			len(run.Failed()),
+			strings.Join(keep[run.ID], ","),
+		)
+	}
+}
+
+func Prune(ctx context.Context, dryRun bool) {
+	config, err := Config()
+	if err != nil {
+		panic(err)
+	}
+
+	l := slog.New(slog.NewTextHandler(os.Stdout, nil)).With("dry-run", dryRun)
+	if !config.Retention.Enabled() {
+		panic(fmt.Errorf("no retention policy configured"))
+	}
+
+	runs, err := RcloneListRuns(ctx, config, ListRunsOptions{
+		log: l.With("target", config.Crypt.Name),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	// without any snapshot, every noncurrent version would be deleted
+	if len(runs) == 0 {
+		panic(fmt.Errorf("no backup runs recorded, refusing to prune"))
+	}
+
+	keep := config.Retention.Apply(runs)
+	var snapshots []time.Time
+	var kept []Run
+	var forget []string
+	var newest time.Time
+	for _, run := range runs {
+		if run.FinishedAt.After(newest) {
+			newest = run.FinishedAt
+		}
+
+		if reasons, ok := keep[run.ID]; ok {
+			l.Info("keeping snapshot", "run", run.ID, "finished", run.FinishedAt, "reasons", reasons)
+			snapshots = append(snapshots, run.Snapshot())
+			kept = append(kept, run)
+			continue
+		}
+
+		l.Info("forgetting snapshot", "run", run.ID, "finished", run.FinishedAt)
+		forget = append(forget, run.ID)
+	}
+
+	dest, err := NewMinio(l.With("target", config.Dest.Name), config.Dest.Value)
+	if err != nil {
+		panic(err)
+	}
+
+	versions, err := dest.ListObjectVersions(ctx, config.BackupBucket)
+	if err != nil {
+		panic(err)
+	}
+
+	deletes := planPrune(versions, snapshots, newest)
+	var size int64
+	for _, v := range deletes {
+		size += v.Size
+	}
+
+	metas, err := RcloneListMeta(ctx, config, ListMetaOptions{log: l.With("target", config.Crypt.Name)})
+	if err != nil {
+		panic(err)
+	}
+
+	latest, err := RcloneLatestMeta(ctx, config, LatestMetaOptions{log: l.With("target", config.Crypt.Name)})
+	if err != nil {
+		panic(err)
+	}
+
+	forgetMeta := planForgetMeta(metas, kept, latest, newest)
+	for _, id := range forgetMeta {
+		l.Info("forgetting metadata archive", "metadata", id)
+	}
+
+	l.Info("planned prune", "versions", len(versions), "deletes", len(deletes), "bytes", size)
+	if dryRun {
+		for _, v := range deletes {
+			fmt.Printf("%s\t%s\t%s\t%d\n", v.Key, v.VersionID, v.LastModified.Format(time.RFC3339), v.Size)
+		}
+
+		return
+	}
+
+	err = RcloneForgetRuns(ctx, config, ForgetRunsOptions{
+		IDs: forget,
+		log: l.With("target", config.Crypt.Name),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	err = RcloneForgetMeta(ctx, config, ForgetMetaOptions{
+		IDs: forgetMeta,
+		log: l.With("target", config.Crypt.Name),
+	})
+	if err != nil {
+		panic(err)
+	}
+
+	err = dest.RemoveObjectVersions(ctx, config.BackupBucket, deletes)
+	if err != nil {
+		panic(err)
+	}
+
+	l.Info("prune complete", "deleted", len(deletes), "bytes", size, "forgotten", len(forget), "metadata", len(forgetMeta))
 }
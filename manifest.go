@@ -0,0 +1,441 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime/debug"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// fileManifest is the name of the first file of a metadata archive, describing its contents
+	fileManifest = "manifest.json"
+
+	// metadataFormatVersion is the version of the metadata archive format written by this version of s32s3.
+	// Version 1 archives have no manifest.
+	metadataFormatVersion = 2
+)
+
+// version is the version of s32s3, set at build time.
+var version = ""
+
+// toolVersion returns the version of s32s3, falling back to the module version for builds without one.
+func toolVersion() string {
+	if version != "" {
+		return version
+	}
+
+	if info, ok := debug.ReadBuildInfo(); ok {
+		return info.Main.Version
+	}
+
+	return "unknown"
+}
+
+// Manifest describes the contents of a metadata archive.
+type Manifest struct {
+	FormatVersion int             `json:"formatVersion"`
+	CreatedAt     time.Time       `json:"createdAt"`
+	ToolVersion   string          `json:"toolVersion"`
+	Source        ManifestSource  `json:"source"`
+	Entries       []ManifestEntry `json:"entries"`
+	// ContentHash is a hash of the exported metadata, which unlike the checksums of the entries
+	// doesn't depend on the timestamps or ordering of the files in the exported zip archives.
+	ContentHash string `json:"contentHash,omitempty"`
+}
+
+// ManifestSource identifies the instance the metadata was exported from.
+type ManifestSource struct {
+	Provider     string `json:"provider,omitempty"`
+	MinioVersion string `json:"minioVersion,omitempty"`
+	DeploymentID string `json:"deploymentId,omitempty"`
+}
+
+// ManifestEntry describes a single file of a metadata archive.
+type ManifestEntry struct {
+	Name   string `json:"name"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// Entry returns the entry of the manifest with the specified name.
+func (m Manifest) Entry(name string) (ManifestEntry, bool) {
+	for _, e := range m.Entries {
+		if e.Name == name {
+			return e, true
+		}
+	}
+
+	return ManifestEntry{}, false
+}
+
+// metaEntry is a file to be written to a metadata archive, spooled to a local file.
+type metaEntry struct {
+	name   string
+	path   string
+	size   int64
+	sha256 string
+}
+
+// spoolEntry streams r into a file in dir, computing its size and checksum on the way,
+// so that exports of any size can be archived without buffering them in memory.
+func spoolEntry(dir string, name string, r io.Reader) (metaEntry, error) {
+	return spoolWriter(dir, name, func(w io.Writer) error {
+		_, err := io.Copy(w, r)
+		return err
+	})
+}
+
+// spoolWriter spools everything write writes into a file in dir, like spoolEntry.
+func spoolWriter(dir string, name string, write func(w io.Writer) error) (metaEntry, error) {
+	f, err := os.CreateTemp(dir, "spool-*")
+	if err != nil {
+		return metaEntry{}, err
+	}
+
+	h := sha256.New()
+	counter := &countingWriter{}
+	err = write(io.MultiWriter(f, h, counter))
+	if err != nil {
+		f.Close()
+		return metaEntry{}, fmt.Errorf("spool %s: %w", name, err)
+	}
+
+	if err := f.Close(); err != nil {
+		return metaEntry{}, fmt.Errorf("spool %s: %w", name, err)
+	}
+
+	return metaEntry{
+		name:   name,
+		path:   f.Name(),
+		size:   counter.n,
+		sha256: hex.EncodeToString(h.Sum(nil)),
+	}, nil
+}
+
+// countingWriter counts the bytes written to it.
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// writeMetaArchive writes a metadata archive to w, with the manifest as the first entry followed by the entries.
+// The entries of the manifest are filled in from the entries.
+func writeMetaArchive(w io.Writer, manifest Manifest, entries []metaEntry) error {
+	manifest.FormatVersion = metadataFormatVersion
+	manifest.Entries = nil
+	for _, e := range entries {
+		manifest.Entries = append(manifest.Entries, ManifestEntry{
+			Name:   e.name,
+			Size:   e.size,
+			SHA256: e.sha256,
+		})
+	}
+
+	data, err := json.MarshalIndent(manifest, "", "  ")
+	if err != nil {
+		return fmt.Errorf("marshal manifest: %w", err)
+	}
+
+	gzw := gzip.NewWriter(w)
+	archive := tar.NewWriter(gzw)
+	err = archive.WriteHeader(&tar.Header{
+		Name:    fileManifest,
+		Mode:    0o644,
+		Size:    int64(len(data)),
+		ModTime: manifest.CreatedAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = archive.Write(data)
+	if err != nil {
+		return fmt.Errorf("write %s: %w", fileManifest, err)
+	}
+
+	for _, e := range entries {
+		err = archive.WriteHeader(&tar.Header{
+			Name:    e.name,
+			Mode:    0o644,
+			Size:    e.size,
+			ModTime: manifest.CreatedAt,
+		})
+		if err != nil {
+			return err
+		}
+
+		err = copyFile(archive, e.path)
+		if err != nil {
+			return fmt.Errorf("write %s: %w", e.name, err)
+		}
+	}
+
+	if err := archive.Close(); err != nil {
+		return fmt.Errorf("close tar: %w", err)
+	}
+
+	if err := gzw.Close(); err != nil {
+		return fmt.Errorf("close gzip: %w", err)
+	}
+
+	return nil
+}
+
+// contentHash returns a canonical hash of the entries, see Manifest.ContentHash.
+// Zip archives are hashed by the names and contents of their files, sorted by name.
+func contentHash(entries []metaEntry) (string, error) {
+	entries = slices.Clone(entries)
+	slices.SortFunc(entries, func(a, b metaEntry) int {
+		return strings.Compare(a.name, b.name)
+	})
+
+	h := sha256.New()
+	for _, e := range entries {
+		fmt.Fprintf(h, "%s\x00", e.name)
+		if filepath.Ext(e.name) != ".zip" {
+			fmt.Fprintf(h, "%s\x00", e.sha256)
+			continue
+		}
+
+		err := hashZip(h, e.path)
+		if err != nil {
+			return "", fmt.Errorf("hash %s: %w", e.name, err)
+		}
+	}
+
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+func hashZip(w io.Writer, path string) error {
+	r, err := zip.OpenReader(path)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	files := slices.Clone(r.File)
+	slices.SortFunc(files, func(a, b *zip.File) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	for _, f := range files {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		rc, err := f.Open()
+		if err != nil {
+			return err
+		}
+
+		h := sha256.New()
+		_, err = io.Copy(h, rc)
+		rc.Close()
+		if err != nil {
+			return fmt.Errorf("read %s: %w", f.Name, err)
+		}
+
+		fmt.Fprintf(w, "%s\x00%x\x00", f.Name, h.Sum(nil))
+	}
+
+	return nil
+}
+
+func copyFile(w io.Writer, path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	_, err = io.Copy(w, f)
+	return err
+}
+
+// MetaArchive is a metadata archive extracted to a directory, with its checksums verified.
+type MetaArchive struct {
+	Manifest Manifest
+	Dir      string
+}
+
+// Has reports whether the archive contains the named entry.
+func (a MetaArchive) Has(name string) bool {
+	_, ok := a.Manifest.Entry(name)
+	return ok
+}
+
+// Open opens the named entry of the archive.
+func (a MetaArchive) Open(name string) (*os.File, error) {
+	if !a.Has(name) {
+		return nil, fmt.Errorf("metadata archive has no %s", name)
+	}
+
+	return os.Open(filepath.Join(a.Dir, name))
+}
+
+// ReadManifest reads only the manifest of the metadata archive at file, without extracting or verifying it.
+// Version 1 archives have no manifest, for them an empty manifest with format version 1 is returned.
+func ReadManifest(file string) (Manifest, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return Manifest{}, err
+	}
+	defer gzr.Close()
+
+	archive := tar.NewReader(gzr)
+	header, err := archive.Next()
+	if err == io.EOF || (err == nil && header.Name != fileManifest) {
+		return Manifest{FormatVersion: 1}, nil
+	}
+	if err != nil {
+		return Manifest{}, err
+	}
+
+	manifest := Manifest{}
+	err = json.NewDecoder(archive).Decode(&manifest)
+	if err != nil {
+		return Manifest{}, fmt.Errorf("decode manifest: %w", err)
+	}
+
+	return manifest, nil
+}
+
+// ReadMetaArchive extracts the metadata archive at file into dir and verifies it against its manifest.
+//
+// Archives written by newer versions of s32s3 with an unknown format version are refused.
+// Version 1 archives without a manifest are migrated, by creating a manifest for their entries.
+func ReadMetaArchive(file string, dir string) (MetaArchive, error) {
+	f, err := os.Open(file)
+	if err != nil {
+		return MetaArchive{}, err
+	}
+	defer f.Close()
+
+	gzr, err := gzip.NewReader(f)
+	if err != nil {
+		return MetaArchive{}, err
+	}
+	defer gzr.Close()
+
+	err = os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return MetaArchive{}, err
+	}
+
+	var manifest *Manifest
+	var found []ManifestEntry
+	archive := tar.NewReader(gzr)
+	for i := 0; ; i++ {
+		header, err := archive.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return MetaArchive{}, err
+		}
+
+		if header.Typeflag != tar.TypeReg {
+			continue
+		}
+
+		if header.Name == fileManifest {
+			if i != 0 {
+				return MetaArchive{}, fmt.Errorf("%s must be the first entry of the archive", fileManifest)
+			}
+
+			manifest = &Manifest{}
+			err = json.NewDecoder(archive).Decode(manifest)
+			if err != nil {
+				return MetaArchive{}, fmt.Errorf("decode manifest: %w", err)
+			}
+
+			if manifest.FormatVersion > metadataFormatVersion {
+				return MetaArchive{}, fmt.Errorf("unsupported metadata format version %d, this version of s32s3 supports up to %d", manifest.FormatVersion, metadataFormatVersion)
+			}
+
+			continue
+		}
+
+		name := filepath.Clean(header.Name)
+		if !filepath.IsLocal(name) {
+			return MetaArchive{}, fmt.Errorf("invalid file name in metadata archive: %s", header.Name)
+		}
+
+		h := sha256.New()
+		err = writeFile(filepath.Join(dir, name), io.TeeReader(archive, h))
+		if err != nil {
+			return MetaArchive{}, fmt.Errorf("extract %s: %w", name, err)
+		}
+
+		found = append(found, ManifestEntry{
+			Name:   header.Name,
+			Size:   header.Size,
+			SHA256: hex.EncodeToString(h.Sum(nil)),
+		})
+	}
+
+	if manifest == nil {
+		return MetaArchive{
+			Manifest: Manifest{FormatVersion: 1, Entries: found},
+			Dir:      dir,
+		}, nil
+	}
+
+	if err := verifyManifest(*manifest, found); err != nil {
+		return MetaArchive{}, err
+	}
+
+	return MetaArchive{Manifest: *manifest, Dir: dir}, nil
+}
+
+// verifyManifest checks that the entries found in an archive match the ones listed in its manifest.
+func verifyManifest(manifest Manifest, found []ManifestEntry) error {
+	if len(found) != len(manifest.Entries) {
+		return fmt.Errorf("manifest lists %d entries, archive contains %d", len(manifest.Entries), len(found))
+	}
+
+	for _, f := range found {
+		want, ok := manifest.Entry(f.Name)
+		if !ok {
+			return fmt.Errorf("%s is not listed in the manifest", f.Name)
+		}
+
+		if want.Size != f.Size || want.SHA256 != f.SHA256 {
+			return fmt.Errorf("%s: checksum mismatch, expected sha256 %s, got %s", f.Name, want.SHA256, f.SHA256)
+		}
+	}
+
+	return nil
+}
+
+// marshalManifest returns the manifest as it is written to a local directory.
+func marshalManifest(m Manifest) (*bytes.Reader, error) {
+	data, err := json.MarshalIndent(m, "", "  ")
+	if err != nil {
+		return nil, err
+	}
+
+	return bytes.NewReader(data), nil
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetaArchive(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, SourceMetadata)
+	f, err := os.Create(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var entries []metaEntry
+	for name, data := range map[string]string{fileIAM: "iam", fileConfig: "region name=us-east-1"} {
+		entry, err := spoolEntry(dir, name, strings.NewReader(data))
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		entries = append(entries, entry)
+	}
+
+	err = writeMetaArchive(f, Manifest{CreatedAt: time.Now()}, entries)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	archive, err := ReadMetaArchive(file, filepath.Join(dir, "out"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if archive.Manifest.FormatVersion != metadataFormatVersion {
+		t.Errorf("expected format version %d, got %d", metadataFormatVersion, archive.Manifest.FormatVersion)
+	}
+
+	if !archive.Has(fileIAM) || !archive.Has(fileConfig) || archive.Has(fileBuckets) {
+		t.Errorf("unexpected entries: %+v", archive.Manifest.Entries)
+	}
+
+	data, err := os.ReadFile(filepath.Join(archive.Dir, fileConfig))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if string(data) != "region name=us-east-1" {
+		t.Errorf("unexpected config: %q", data)
+	}
+}
+
+type rawEntry struct {
+	name string
+	data []byte
+}
+
+// writeRawArchive writes a tar.gz archive with the entries in order, without a generated manifest.
+func writeRawArchive(t *testing.T, entries ...rawEntry) string {
+	t.Helper()
+	buf := bytes.NewBuffer(nil)
+	gzw := gzip.NewWriter(buf)
+	archive := tar.NewWriter(gzw)
+	for _, e := range entries {
+		archive.WriteHeader(&tar.Header{Name: e.name, Mode: 0o644, Size: int64(len(e.data))})
+		archive.Write(e.data)
+	}
+	archive.Close()
+	gzw.Close()
+
+	file := filepath.Join(t.TempDir(), SourceMetadata)
+	if err := os.WriteFile(file, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	return file
+}
+
+func TestReadMetaArchiveVersion1(t *testing.T) {
+	file := writeRawArchive(t, rawEntry{name: fileIAM, data: []byte("iam")})
+	archive, err := ReadMetaArchive(file, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if archive.Manifest.FormatVersion != 1 || !archive.Has(fileIAM) {
+		t.Errorf("unexpected manifest: %+v", archive.Manifest)
+	}
+}
+
+func TestReadMetaArchiveRejects(t *testing.T) {
+	cases := []struct {
+		name    string
+		entries []rawEntry
+		err     string
+	}{
+		{
+			name: "future version",
+			entries: []rawEntry{
+				{name: fileManifest, data: []byte(`{"formatVersion": 99}`)},
+			},
+			err: "unsupported metadata format version 99",
+		},
+		{
+			name: "checksum mismatch",
+			entries: []rawEntry{
+				{name: fileManifest, data: []byte(`{"formatVersion": 2, "entries": [{"name": "iam.zip", "size": 3, "sha256": "00"}]}`)},
+				{name: fileIAM, data: []byte("iam")},
+			},
+			err: "checksum mismatch",
+		},
+		{
+			name: "unlisted entry",
+			entries: []rawEntry{
+				{name: fileManifest, data: []byte(`{"formatVersion": 2, "entries": []}`)},
+				{name: fileIAM, data: []byte("iam")},
+			},
+			err: "manifest lists 0 entries",
+		},
+		{
+			name: "manifest not first",
+			entries: []rawEntry{
+				{name: fileIAM, data: []byte("iam")},
+				{name: fileManifest, data: []byte(`{"formatVersion": 2}`)},
+			},
+			err: "must be the first entry",
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			_, err := ReadMetaArchive(writeRawArchive(t, c.entries...), t.TempDir())
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("expected error containing %q, got %v", c.err, err)
+			}
+		})
+	}
+}
+
+func TestContentHash(t *testing.T) {
+	hash := func(files []rawEntry, modified time.Time, config string) string {
+		t.Helper()
+		dir := t.TempDir()
+		buf := bytes.NewBuffer(nil)
+		w := zip.NewWriter(buf)
+		for _, e := range files {
+			f, err := w.CreateHeader(&zip.FileHeader{Name: e.name, Modified: modified, Method: zip.Deflate})
+			if err != nil {
+				t.Fatal(err)
+			}
+			f.Write(e.data)
+		}
+		w.Close()
+
+		var entries []metaEntry
+		for name, r := range map[string]io.Reader{fileIAM: buf, fileConfig: strings.NewReader(config)} {
+			entry, err := spoolEntry(dir, name, r)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, entry)
+		}
+
+		h, err := contentHash(entries)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return h
+	}
+
+	users := rawEntry{name: "iam-assets/users.json", data: []byte(`{"alice": {}}`)}
+	policies := rawEntry{name: "iam-assets/policies.json", data: []byte(`{}`)}
+	base := hash([]rawEntry{users, policies}, time.Unix(0, 0), "api requests_max=0")
+
+	if h := hash([]rawEntry{policies, users}, time.Now(), "api requests_max=0"); h != base {
+		t.Error("expected hash to ignore zip timestamps and ordering")
+	}
+
+	if h := hash([]rawEntry{users, policies}, time.Unix(0, 0), "api requests_max=10"); h == base {
+		t.Error("expected hash to change with the config")
+	}
+
+	users.data = []byte(`{"bob": {}}`)
+	if h := hash([]rawEntry{users, policies}, time.Unix(0, 0), "api requests_max=0"); h == base {
+		t.Error("expected hash to change with the zip contents")
+	}
+}
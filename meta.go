@@ -0,0 +1,445 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/rclone/rclone/fs"
+)
+
+const (
+	// metadataDir is the directory in the crypt remote holding one metadata archive per backup run, named by run ID.
+	metadataDir = stateDir + "/metadata"
+
+	// metadataLatest is the file in metadataDir holding the ID of the most recent metadata archive.
+	metadataLatest = "latest"
+
+	// metadataExt is the extension of metadata archives in metadataDir.
+	metadataExt = ".tar.gz"
+)
+
+// MetaInfo describes a metadata archive stored in the crypt remote.
+type MetaInfo struct {
+	ID      string
+	Created time.Time
+	Size    int64
+}
+
+type UploadMetaOptions struct {
+	File string
+	ID   string
+	log  *slog.Logger
+}
+
+// RcloneUploadMeta stores a metadata archive in the crypt remote under the specified ID, and points latest to it.
+func RcloneUploadMeta(ctx context.Context, config BackupConfig, opts UploadMetaOptions) error {
+	dir, err := os.MkdirTemp("", "s32s3-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	archive := filepath.Join(dir, opts.ID+metadataExt)
+	err = os.Rename(opts.File, archive)
+	if err != nil {
+		return err
+	}
+
+	err = RcloneSyncFile(ctx, config, SyncFileOptions{
+		File: archive,
+		Dest: config.Crypt.Name,
+		Dir:  metadataDir,
+		log:  opts.log,
+	})
+	if err != nil {
+		return fmt.Errorf("upload metadata: %w", err)
+	}
+
+	latest := filepath.Join(dir, metadataLatest)
+	err = os.WriteFile(latest, []byte(opts.ID+"\n"), 0o644)
+	if err != nil {
+		return err
+	}
+
+	err = RcloneSyncFile(ctx, config, SyncFileOptions{
+		File: latest,
+		Dest: config.Crypt.Name,
+		Dir:  metadataDir,
+		log:  opts.log,
+	})
+	if err != nil {
+		return fmt.Errorf("update latest metadata: %w", err)
+	}
+
+	return nil
+}
+
+type UnchangedMetaOptions struct {
+	File string
+	log  *slog.Logger
+}
+
+// RcloneUnchangedMeta returns the ID of the latest metadata archive if its content matches the archive at File,
+// or an empty string if the metadata changed or the latest archive can't be compared.
+func RcloneUnchangedMeta(ctx context.Context, config BackupConfig, opts UnchangedMetaOptions) (string, error) {
+	current, err := ReadManifest(opts.File)
+	if err != nil {
+		return "", err
+	}
+
+	if current.ContentHash == "" {
+		return "", nil
+	}
+
+	latest, err := RcloneLatestMeta(ctx, config, LatestMetaOptions{log: opts.log})
+	if err != nil || latest == "" {
+		return "", err
+	}
+
+	file, err := RcloneDownloadFile(ctx, config, DownloadFileOptions{
+		File:   path.Join(metadataDir, latest+metadataExt),
+		Source: config.Crypt.Name,
+		log:    opts.log,
+	})
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(filepath.Dir(file))
+
+	previous, err := ReadManifest(file)
+	if err != nil {
+		return "", err
+	}
+
+	if previous.ContentHash != current.ContentHash {
+		return "", nil
+	}
+
+	return latest, nil
+}
+
+type ListMetaOptions struct {
+	log *slog.Logger
+}
+
+// RcloneListMeta returns the metadata archives stored in the crypt remote, oldest first.
+func RcloneListMeta(ctx context.Context, config BackupConfig, opts ListMetaOptions) ([]MetaInfo, error) {
+	files, err := RcloneList(ctx, config, ListOptions{
+		Path:   metadataDir,
+		Remote: config.Crypt.Name,
+		log:    opts.log,
+	})
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == rcloneExitDirNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var out []MetaInfo
+	for _, f := range files {
+		id, ok := strings.CutSuffix(f.Name, metadataExt)
+		if !ok || f.IsDir {
+			continue
+		}
+
+		created, err := time.Parse(runIDFormat, id)
+		if err != nil {
+			opts.log.Warn("ignoring unexpected file in metadata directory", "file", f.Name)
+			continue
+		}
+
+		out = append(out, MetaInfo{ID: id, Created: created, Size: f.Size})
+	}
+
+	slices.SortFunc(out, func(a, b MetaInfo) int {
+		return a.Created.Compare(b.Created)
+	})
+
+	return out, nil
+}
+
+type ForgetMetaOptions struct {
+	IDs []string
+	log *slog.Logger
+}
+
+// RcloneForgetMeta deletes the specified metadata archives from the crypt remote.
+func RcloneForgetMeta(ctx context.Context, config BackupConfig, opts ForgetMetaOptions) error {
+	for _, id := range opts.IDs {
+		err := RcloneDeleteFile(ctx, config, DeleteFileOptions{
+			File:   path.Join(metadataDir, id+metadataExt),
+			Remote: config.Crypt.Name,
+			log:    opts.log.With("metadata", id),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+type LatestMetaOptions struct {
+	log *slog.Logger
+}
+
+// RcloneLatestMeta returns the ID of the metadata archive latest points to, or an empty string if there is none.
+func RcloneLatestMeta(ctx context.Context, config BackupConfig, opts LatestMetaOptions) (string, error) {
+	metas, err := RcloneListMeta(ctx, config, ListMetaOptions{log: opts.log})
+	if err != nil {
+		return "", err
+	}
+
+	if len(metas) == 0 {
+		return "", nil
+	}
+
+	buf := bytes.NewBuffer(nil)
+	err = RcloneCat(ctx, config, CatOptions{
+		Path:   path.Join(metadataDir, metadataLatest),
+		Source: config.Crypt.Name,
+		Out:    buf,
+		log:    opts.log,
+	})
+	if err != nil {
+		// an interrupted upload may leave an archive without pointer, fall back to the newest archive
+		opts.log.Warn("failed to read latest metadata pointer, using newest archive", "err", err)
+		return metas[len(metas)-1].ID, nil
+	}
+
+	return strings.TrimSpace(buf.String()), nil
+}
+
+type DownloadMetaOptions struct {
+	// ID selects the metadata archive to download. If empty, the archive is chosen by At.
+	ID string
+	// At selects the newest metadata archive created at or before the time. If nil, latest is used.
+	At  *string
+	log *slog.Logger
+}
+
+// RcloneDownloadMeta downloads a metadata archive from the crypt remote to a temporary directory.
+// Backups from before metadata archives were kept per run only have a single archive in the root of the remote,
+// which is used as a fallback if no archive is found.
+func RcloneDownloadMeta(ctx context.Context, config BackupConfig, opts DownloadMetaOptions) (string, error) {
+	id := opts.ID
+	if id == "" {
+		var err error
+		id, err = findMeta(ctx, config, opts.At, opts.log)
+		if err != nil {
+			return "", err
+		}
+	}
+
+	if id == "" {
+		opts.log.Warn("no metadata archive found, falling back to legacy archive", "file", SourceMetadata)
+		return RcloneDownloadFile(ctx, config, DownloadFileOptions{
+			File:   SourceMetadata,
+			Source: config.Crypt.Name,
+			At:     opts.At,
+			log:    opts.log,
+		})
+	}
+
+	opts.log.Info("using metadata archive", "id", id)
+	return RcloneDownloadFile(ctx, config, DownloadFileOptions{
+		File:   path.Join(metadataDir, id+metadataExt),
+		Source: config.Crypt.Name,
+		log:    opts.log,
+	})
+}
+
+// findMeta returns the ID of the newest metadata archive created at or before at, or latest if at is nil.
+func findMeta(ctx context.Context, config BackupConfig, at *string, log *slog.Logger) (string, error) {
+	if at == nil {
+		return RcloneLatestMeta(ctx, config, LatestMetaOptions{log: log})
+	}
+
+	t, err := fs.ParseTime(*at)
+	if err != nil {
+		return "", fmt.Errorf("parse time %q: %w", *at, err)
+	}
+
+	metas, err := RcloneListMeta(ctx, config, ListMetaOptions{log: log})
+	if err != nil {
+		return "", err
+	}
+
+	id := ""
+	for _, m := range metas {
+		if m.Created.After(t) {
+			break
+		}
+
+		id = m.ID
+	}
+
+	return id, nil
+}
+
+// RestoreMetaOptions selects the parts of the instance metadata to restore.
+// The server config is filtered and rewritten by ConfigFilter before it is restored.
+// OnlyBuckets limits the restored bucket metadata to these buckets, all buckets of the archive are restored if empty.
+type RestoreMetaOptions struct {
+	IAM          bool
+	Buckets      bool
+	Config       bool
+	ConfigFilter ConfigFilter
+	OnlyBuckets  []string
+}
+
+// filterBucketZip returns a copy of a zip archive holding a directory per bucket, such as the bucket metadata,
+// with only the directories of the buckets.
+func filterBucketZip(data []byte, buckets []string) ([]byte, error) {
+	files, err := readZip(data)
+	if err != nil {
+		return nil, err
+	}
+
+	buf := bytes.NewBuffer(nil)
+	w := zip.NewWriter(buf)
+	for _, name := range mapKeys(files) {
+		bucket, _, _ := strings.Cut(name, "/")
+		if !slices.Contains(buckets, bucket) {
+			continue
+		}
+
+		f, err := w.Create(name)
+		if err != nil {
+			return nil, err
+		}
+
+		if _, err := f.Write(files[name]); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+
+	return buf.Bytes(), nil
+}
+
+// Any reports whether any part of the metadata is selected.
+func (o RestoreMetaOptions) Any() bool {
+	return o.IAM || o.Buckets || o.Config
+}
+
+// ParseRestoreMetaOptions parses a comma separated list of metadata parts: iam, buckets and config.
+func ParseRestoreMetaOptions(s string) (RestoreMetaOptions, error) {
+	var out RestoreMetaOptions
+	for _, part := range strings.Split(s, ",") {
+		switch strings.TrimSpace(part) {
+		case "iam":
+			out.IAM = true
+		case "buckets":
+			out.Buckets = true
+		case "config":
+			out.Config = true
+		case "":
+		default:
+			return RestoreMetaOptions{}, fmt.Errorf("unknown metadata part %q, expected iam, buckets or config", part)
+		}
+	}
+
+	return out, nil
+}
+
+type MetaRestoreOptions struct {
+	At   *string
+	Run  string
+	From string
+	Meta RestoreMetaOptions
+}
+
+// MetaRestore restores instance metadata onto the source instance, without restoring any data.
+func MetaRestore(ctx context.Context, opts MetaRestoreOptions) {
+	config, err := Config()
+	if err != nil {
+		panic(err)
+	}
+
+	if err := config.ValidateSource(); err != nil {
+		panic(err)
+	}
+
+	l := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	opts.Meta.ConfigFilter = config.RestoreConfig.Merge(opts.Meta.ConfigFilter)
+	file, err := downloadMeta(ctx, config, opts.At, opts.Run, opts.From, l.With("target", config.Crypt.Name))
+	if err != nil {
+		panic(err)
+	}
+
+	m, err := NewMinio(l.With("target", config.Source.Name), config.Source.Value)
+	if err != nil {
+		panic(err)
+	}
+
+	err = RestoreMetadata(ctx, NewMetadataExporter(m), file, opts.Meta, l.With("target", config.Source.Name))
+	if err != nil {
+		panic(err)
+	}
+
+	l.Info("metadata restore complete")
+}
+
+// downloadMeta downloads the metadata archive with the ID from, or the one belonging to the backup run or time.
+func downloadMeta(ctx context.Context, config BackupConfig, at *string, runID string, from string, log *slog.Logger) (string, error) {
+	at, run, err := resolveAt(ctx, config, at, runID, log)
+	if err != nil {
+		return "", err
+	}
+
+	id := from
+	if id == "" && run != nil {
+		id = run.Metadata
+	}
+
+	return RcloneDownloadMeta(ctx, config, DownloadMetaOptions{
+		ID:  id,
+		At:  at,
+		log: log,
+	})
+}
+
+// MetaList prints the metadata archives stored in the backup.
+func MetaList(ctx context.Context) {
+	config, err := Config()
+	if err != nil {
+		panic(err)
+	}
+
+	l := slog.New(slog.NewTextHandler(os.Stderr, nil)).With("target", config.Crypt.Name)
+	metas, err := RcloneListMeta(ctx, config, ListMetaOptions{log: l})
+	if err != nil {
+		panic(err)
+	}
+
+	latest, err := RcloneLatestMeta(ctx, config, LatestMetaOptions{log: l})
+	if err != nil {
+		panic(err)
+	}
+
+	for _, m := range metas {
+		mark := ""
+		if m.ID == latest {
+			mark = "latest"
+		}
+
+		fmt.Printf("%s\t%s\t%d\t%s\n", m.ID, m.Created.Format(time.RFC3339), m.Size, mark)
+	}
+}
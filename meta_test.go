@@ -0,0 +1,30 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestFilterBucketZip(t *testing.T) {
+	data := writeZip(t, map[string]string{
+		"logs/versioning.xml":  `<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>`,
+		"logs/quota.json":      `{"quota": 1024, "quotatype": "hard"}`,
+		"logs-old/policy.json": `{}`,
+		"data/lifecycle.xml":   `<LifecycleConfiguration></LifecycleConfiguration>`,
+	})
+
+	filtered, err := filterBucketZip(data, []string{"logs"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := readZip(filtered)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"logs/quota.json", "logs/versioning.xml"}
+	if got := mapKeys(files); !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
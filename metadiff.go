@@ -0,0 +1,379 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/minio/madmin-go/v3"
+)
+
+// Kinds of differences between two metadata archives.
+const (
+	metaAdded   = "added"
+	metaRemoved = "removed"
+	metaChanged = "changed"
+)
+
+// configSecretKeys are substrings of config keys whose values are not printed in diffs.
+var configSecretKeys = []string{"secret", "password", "token", "private_key", "client_key"}
+
+// MetaChange is a difference between the metadata of an archive and a newer state of the instance.
+type MetaChange struct {
+	Op string
+	// Part is the part of the metadata: iam, buckets or config.
+	Part string
+	Name string
+	// Detail describes the change, it may be empty.
+	Detail string
+}
+
+func (c MetaChange) String() string {
+	return fmt.Sprintf("%s\t%s\t%s\t%s", c.Op, c.Part, c.Name, c.Detail)
+}
+
+// DiffMeta compares the metadata of two archives, reporting what changed from before to after.
+// Parts missing from either archive are skipped. The readable bucket configuration is only compared
+// if the bucket metadata of MinIO isn't, as archives of MinIO sources hold both.
+func DiffMeta(before, after MetaArchive, log *slog.Logger) ([]MetaChange, error) {
+	var out []MetaChange
+	for _, part := range []struct {
+		file string
+		diff func(before, after []byte) ([]MetaChange, error)
+	}{
+		{fileIAM, diffIAMExports},
+		{fileBuckets, diffBucketMetadata},
+		{fileBucketConfig, diffBucketMetadata},
+		{fileConfig, diffConfig},
+	} {
+		if part.file == fileBucketConfig && before.Has(fileBuckets) && after.Has(fileBuckets) {
+			continue
+		}
+
+		if !before.Has(part.file) || !after.Has(part.file) {
+			log.Warn("skipping metadata part missing from archive", "file", part.file)
+			continue
+		}
+
+		a, err := os.ReadFile(filepath.Join(before.Dir, part.file))
+		if err != nil {
+			return nil, err
+		}
+
+		b, err := os.ReadFile(filepath.Join(after.Dir, part.file))
+		if err != nil {
+			return nil, err
+		}
+
+		changes, err := part.diff(a, b)
+		if err != nil {
+			return nil, fmt.Errorf("diff %s: %w", part.file, err)
+		}
+
+		out = append(out, changes...)
+	}
+
+	return out, nil
+}
+
+func diffIAMExports(before, after []byte) ([]MetaChange, error) {
+	a, err := ParseIAMExport(bytes.NewReader(before), int64(len(before)))
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := ParseIAMExport(bytes.NewReader(after), int64(len(after)))
+	if err != nil {
+		return nil, err
+	}
+
+	// DiffIAM reports the changes needed to get from live to archived,
+	// so the newer export takes the place of the archive
+	sel := IAMSelection{
+		Policies:        unionKeys(a.Policies, b.Policies),
+		Users:           unionKeys(a.Users, b.Users),
+		Groups:          unionKeys(a.Groups, b.Groups),
+		ServiceAccounts: unionKeys(a.ServiceAccounts, b.ServiceAccounts),
+	}
+
+	removed := map[string][]string{
+		iamPolicy:         missingKeys(sel.Policies, b.Policies),
+		iamUser:           missingKeys(sel.Users, b.Users),
+		iamGroup:          missingKeys(sel.Groups, b.Groups),
+		iamServiceAccount: missingKeys(sel.ServiceAccounts, b.ServiceAccounts),
+	}
+
+	var out []MetaChange
+	for _, c := range DiffIAM(b, a, sel) {
+		switch {
+		case slices.Contains(removed[c.Kind], c.Name):
+			out = append(out, MetaChange{Op: metaRemoved, Part: "iam", Name: c.Kind + " " + c.Name})
+		case c.Create:
+			out = append(out, MetaChange{Op: metaAdded, Part: "iam", Name: c.Kind + " " + c.Name})
+		case !c.Unchanged():
+			out = append(out, MetaChange{Op: metaChanged, Part: "iam", Name: c.Kind + " " + c.Name, Detail: strings.Join(c.Changes, "; ")})
+		}
+	}
+
+	return out, nil
+}
+
+func unionKeys[V any](a, b map[string]V) []string {
+	keys := mapKeys(a)
+	for _, k := range mapKeys(b) {
+		if _, ok := a[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	return keys
+}
+
+func missingKeys[V any](keys []string, m map[string]V) []string {
+	var out []string
+	for _, k := range keys {
+		if _, ok := m[k]; !ok {
+			out = append(out, k)
+		}
+	}
+
+	return out
+}
+
+// diffBucketMetadata compares bucket metadata exports, which hold one file per bucket and setting,
+// such as versioning.xml, lifecycle.xml, quota.json, notification.xml or object-lock.xml.
+func diffBucketMetadata(before, after []byte) ([]MetaChange, error) {
+	a, err := readZip(before)
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := readZip(after)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []MetaChange
+	for _, name := range unionKeys(a, b) {
+		bucket, file := path.Split(name)
+		bucket = strings.TrimSuffix(bucket, "/")
+		setting := strings.TrimSuffix(file, path.Ext(file))
+		oldData, inOld := a[name]
+		newData, inNew := b[name]
+
+		change := MetaChange{Part: "buckets", Name: bucket + " " + setting}
+		switch {
+		case !inOld:
+			change.Op = metaAdded
+		case !inNew:
+			change.Op = metaRemoved
+		case path.Ext(file) == ".json" && jsonEqual(oldData, newData):
+			continue
+		case bytes.Equal(bytes.TrimSpace(oldData), bytes.TrimSpace(newData)):
+			continue
+		default:
+			change.Op = metaChanged
+		}
+
+		out = append(out, change)
+	}
+
+	return out, nil
+}
+
+func readZip(data []byte) (map[string][]byte, error) {
+	archive, err := zip.NewReader(bytes.NewReader(data), int64(len(data)))
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string][]byte{}
+	for _, f := range archive.File {
+		if f.FileInfo().IsDir() {
+			continue
+		}
+
+		content, err := readZipFile(f)
+		if err != nil {
+			return nil, err
+		}
+
+		out[f.Name] = content
+	}
+
+	return out, nil
+}
+
+func readZipFile(f *zip.File) ([]byte, error) {
+	r, err := f.Open()
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("read %s: %w", f.Name, err)
+	}
+
+	return content, nil
+}
+
+// diffConfig compares server configs key by key. Values of secret keys are not printed.
+func diffConfig(before, after []byte) ([]MetaChange, error) {
+	a, err := configKVs(string(before))
+	if err != nil {
+		return nil, err
+	}
+
+	b, err := configKVs(string(after))
+	if err != nil {
+		return nil, err
+	}
+
+	var out []MetaChange
+	for _, name := range unionKeys(a, b) {
+		oldValue, inOld := a[name]
+		newValue, inNew := b[name]
+
+		change := MetaChange{Part: "config", Name: name}
+		switch {
+		case !inOld:
+			change.Op = metaAdded
+			change.Detail = configValue(name, newValue)
+		case !inNew:
+			change.Op = metaRemoved
+		case oldValue == newValue:
+			continue
+		default:
+			change.Op = metaChanged
+			change.Detail = configValue(name, oldValue) + " -> " + configValue(name, newValue)
+		}
+
+		out = append(out, change)
+	}
+
+	return out, nil
+}
+
+// configKVs returns the values of a config by `subsys[:target] key`.
+func configKVs(config string) (map[string]string, error) {
+	subsystems, err := madmin.ParseServerConfigOutput(config)
+	if err != nil {
+		return nil, err
+	}
+
+	out := map[string]string{}
+	for _, s := range subsystems {
+		for _, kv := range s.KV {
+			out[subsysName(s)+" "+kv.Key] = kv.Value
+		}
+	}
+
+	return out, nil
+}
+
+func configValue(name, value string) string {
+	for _, s := range configSecretKeys {
+		if strings.Contains(name, s) {
+			return "(redacted)"
+		}
+	}
+
+	return fmt.Sprintf("%q", value)
+}
+
+// exportLiveMeta exports the live metadata of an instance to compare archives with.
+// The returned function removes the exported archive.
+func exportLiveMeta(ctx context.Context, exporter MetadataExporter) (string, func(), error) {
+	file, err := ExportMetadata(ctx, exporter)
+	if err != nil {
+		return "", nil, fmt.Errorf("export live metadata: %w", err)
+	}
+
+	return file, func() { os.RemoveAll(filepath.Dir(file)) }, nil
+}
+
+type MetaDiffOptions struct {
+	At   *string
+	Run  string
+	From string
+	// To is the ID of a metadata archive to compare with instead of the live instance.
+	To string
+}
+
+// MetaDiff prints the differences between archived metadata and the live source instance, or another archive.
+func MetaDiff(ctx context.Context, opts MetaDiffOptions) {
+	config, err := Config()
+	if err != nil {
+		panic(err)
+	}
+
+	l := slog.New(slog.NewTextHandler(os.Stderr, nil))
+	file, err := downloadMeta(ctx, config, opts.At, opts.Run, opts.From, l.With("target", config.Crypt.Name))
+	if err != nil {
+		panic(err)
+	}
+
+	dir, err := os.MkdirTemp("", "s32s3-*")
+	if err != nil {
+		panic(err)
+	}
+	defer os.RemoveAll(dir)
+
+	archived, err := ReadMetaArchive(file, filepath.Join(dir, "archived"))
+	if err != nil {
+		panic(err)
+	}
+
+	if opts.To != "" {
+		file, err = RcloneDownloadMeta(ctx, config, DownloadMetaOptions{
+			ID:  opts.To,
+			log: l.With("target", config.Crypt.Name),
+		})
+		if err != nil {
+			panic(err)
+		}
+	} else {
+		if err := config.ValidateSource(); err != nil {
+			panic(err)
+		}
+
+		m, err := NewMinio(l.With("target", config.Source.Name), config.Source.Value)
+		if err != nil {
+			panic(err)
+		}
+
+		var cleanup func()
+		file, cleanup, err = exportLiveMeta(ctx, NewMetadataExporter(m))
+		if err != nil {
+			panic(err)
+		}
+		defer cleanup()
+	}
+
+	current, err := ReadMetaArchive(file, filepath.Join(dir, "current"))
+	if err != nil {
+		panic(err)
+	}
+
+	changes, err := DiffMeta(archived, current, l)
+	if err != nil {
+		panic(err)
+	}
+
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+
+	l.Info("metadata diff complete", "changes", len(changes))
+}
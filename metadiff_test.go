@@ -0,0 +1,128 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"slices"
+	"testing"
+)
+
+func writeZip(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	buf := bytes.NewBuffer(nil)
+	w := zip.NewWriter(buf)
+	for name, data := range files {
+		f, err := w.Create(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Write([]byte(data))
+	}
+	w.Close()
+
+	return buf.Bytes()
+}
+
+func TestDiffMetaParts(t *testing.T) {
+	before := writeZip(t, map[string]string{
+		"logs/versioning.xml": `<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>`,
+		"logs/quota.json":     `{"quota": 1024, "quotatype": "hard"}`,
+		"data/lifecycle.xml":  `<LifecycleConfiguration></LifecycleConfiguration>`,
+	})
+	after := writeZip(t, map[string]string{
+		"logs/versioning.xml":   `<VersioningConfiguration><Status>Suspended</Status></VersioningConfiguration>`,
+		"logs/quota.json":       `{"quotatype":"hard","quota":1024}`,
+		"data/object-lock.xml":  `<ObjectLockConfiguration></ObjectLockConfiguration>`,
+		"data/notification.xml": `<NotificationConfiguration></NotificationConfiguration>`,
+	})
+
+	changes, err := diffBucketMetadata(before, after)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertChanges(t, changes, []string{
+		"removed\tbuckets\tdata lifecycle\t",
+		"added\tbuckets\tdata notification\t",
+		"added\tbuckets\tdata object-lock\t",
+		"changed\tbuckets\tlogs versioning\t",
+	})
+
+	changes, err = diffConfig(
+		[]byte("site name=eu-1 region=eu-west-1\nidentity_openid client_id=minio client_secret=old\n"),
+		[]byte("site name=eu-2 region=eu-west-1\nidentity_openid client_id=minio client_secret=new\napi requests_max=10\n"),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertChanges(t, changes, []string{
+		"added\tconfig\tapi requests_max\t\"10\"",
+		"changed\tconfig\tidentity_openid client_secret\t(redacted) -> (redacted)",
+		"changed\tconfig\tsite name\t\"eu-1\" -> \"eu-2\"",
+	})
+}
+
+func TestDiffMetaMinioBucketConfig(t *testing.T) {
+	archive := func(status string) MetaArchive {
+		versioning := `<VersioningConfiguration><Status>` + status + `</Status></VersioningConfiguration>`
+		file := writeRawArchive(t,
+			rawEntry{name: fileBuckets, data: writeZip(t, map[string]string{"logs/versioning.xml": versioning})},
+			rawEntry{name: fileBucketConfig, data: writeZip(t, map[string]string{"logs/versioning.xml": versioning})},
+		)
+
+		out, err := ReadMetaArchive(file, t.TempDir())
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return out
+	}
+
+	changes, err := DiffMeta(archive("Enabled"), archive("Suspended"), slog.New(slog.NewTextHandler(io.Discard, nil)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	assertChanges(t, changes, []string{
+		"changed\tbuckets\tlogs versioning\t",
+	})
+}
+
+func assertChanges(t *testing.T, changes []MetaChange, want []string) {
+	t.Helper()
+	var got []string
+	for _, c := range changes {
+		got = append(got, c.String())
+	}
+
+	if !slices.Equal(got, want) {
+		t.Errorf("expected:\n%q\ngot:\n%q", want, got)
+	}
+}
+
+// failingExporter fails to export, as an unreachable instance does.
+type failingExporter struct{}
+
+func (failingExporter) Source(ctx context.Context) (ManifestSource, error) {
+	return ManifestSource{}, nil
+}
+
+func (failingExporter) Export(ctx context.Context, dir string) ([]metaEntry, error) {
+	return nil, errors.New("connection refused")
+}
+
+func (failingExporter) Restore(ctx context.Context, archive MetaArchive, opts RestoreMetaOptions) error {
+	return nil
+}
+
+func TestExportLiveMetaFails(t *testing.T) {
+	file, _, err := exportLiveMeta(context.Background(), failingExporter{})
+	if err == nil {
+		t.Fatalf("expected export error, got archive %q", file)
+	}
+}
@@ -1,15 +1,14 @@
 package main
 
 import (
-	"archive/tar"
 	"bytes"
-	"compress/gzip"
 	"context"
+	"fmt"
 	"io"
 	"log/slog"
 	"net/url"
-	"os"
-	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/minio/madmin-go/v3"
 	"github.com/minio/minio-go/v7"
@@ -41,6 +40,16 @@ func (m *Minio) ListBuckets(ctx context.Context) ([]string, error) {
 	return buckets, nil
 }
 
+// VersioningEnabled reports whether versioning is enabled on the bucket.
+func (m *Minio) VersioningEnabled(ctx context.Context, bucket string) (bool, error) {
+	versioning, err := m.client.GetBucketVersioning(ctx, bucket)
+	if err != nil {
+		return false, err
+	}
+
+	return versioning.Enabled(), nil
+}
+
 const (
 	// SourceMetadata is the name of the file that contains the additional metadata for an instance, such as IAM configuration
 	SourceMetadata = "metadata.tar.gz"
@@ -53,146 +62,191 @@ const (
 
 	// fileConfig is the name of the file that contains the Minio configuration
 	fileConfig = "config.txt"
+
+	// fileBucketConfig is the name of the file that contains the bucket configuration exposed by the S3 API
+	fileBucketConfig = "bucket-config.zip"
 )
 
-// SourceMetadata returns the additional metadata for an instance
+// MinioExporter exports and restores the metadata of a MinIO instance through the admin API.
 //
 // The exported data includes:
 // - IAM configuration (fileIAM)
 // - Bucket metadata (fileBuckets)
+// - Bucket configuration in readable form (fileBucketConfig)
 // - Minio configuration (fileConfig)
-//
-// The exported data is stored in a tar.gz file in the temporary directory, and the path to the file is returned.
-func (m *Minio) SourceMetadata(ctx context.Context) (string, error) {
-	dir, err := os.MkdirTemp("", "s32s3-*")
+type MinioExporter struct {
+	m *Minio
+}
+
+// Source returns the version and deployment ID of the instance.
+func (e MinioExporter) Source(ctx context.Context) (ManifestSource, error) {
+	info, err := e.m.adminClient.ServerInfo(ctx)
 	if err != nil {
-		return "", err
+		return ManifestSource{}, fmt.Errorf("server info: %w", err)
 	}
 
-	f, err := os.Create(filepath.Join(dir, SourceMetadata))
-	if err != nil {
-		return "", err
+	source := ManifestSource{
+		Provider:     providerMinio,
+		DeploymentID: info.DeploymentID,
+	}
+	if len(info.Servers) > 0 {
+		source.MinioVersion = info.Servers[0].Version
 	}
-	defer f.Close()
 
-	gzw := gzip.NewWriter(f)
-	defer gzw.Close()
+	return source, nil
+}
 
-	archive := tar.NewWriter(gzw)
-	defer archive.Close()
+// Export spools the IAM configuration, bucket metadata and server config into dir.
+func (e MinioExporter) Export(ctx context.Context, dir string) ([]metaEntry, error) {
+	var entries []metaEntry
 
 	// IAM
-	iam, err := m.adminClient.ExportIAM(ctx)
-	if err != nil {
-		return "", err
-	}
-
-	buf := bytes.NewBuffer(nil)
-	io.Copy(buf, iam)
-	iam.Close()
+	entry, err := traced(ctx, "ExportIAM", func(ctx context.Context) (metaEntry, error) {
+		iam, err := e.m.adminClient.ExportIAM(ctx)
+		if err != nil {
+			return metaEntry{}, fmt.Errorf("export iam: %w", err)
+		}
+		defer iam.Close()
 
-	err = archive.WriteHeader(&tar.Header{
-		Name: fileIAM,
-		Mode: 0o644,
-		Size: int64(buf.Len()),
+		return spoolEntry(dir, fileIAM, iam)
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	io.Copy(archive, buf)
+	entries = append(entries, entry)
 
 	// Buckets
-	buf.Reset()
-	buckets, err := m.adminClient.ExportBucketMetadata(ctx, "")
+	entry, err = traced(ctx, "ExportBucketMetadata", func(ctx context.Context) (metaEntry, error) {
+		buckets, err := e.m.adminClient.ExportBucketMetadata(ctx, "")
+		if err != nil {
+			return metaEntry{}, fmt.Errorf("export bucket metadata: %w", err)
+		}
+		defer buckets.Close()
+
+		return spoolEntry(dir, fileBuckets, buckets)
+	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	io.Copy(buf, buckets)
-	buckets.Close()
+	entries = append(entries, entry)
 
-	err = archive.WriteHeader(&tar.Header{
-		Name: fileBuckets,
-		Mode: 0o644,
-		Size: int64(buf.Len()),
+	// the same bucket configuration in readable form, which can be restored onto other providers
+	entry, err = traced(ctx, "export bucket config", func(ctx context.Context) (metaEntry, error) {
+		return exportBucketConfig(ctx, e.m, dir)
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
-	io.Copy(archive, buf)
+	entries = append(entries, entry)
 
 	// OIDC
-	buf.Reset()
-	oidc, err := m.adminClient.GetConfig(ctx)
-	if err != nil {
-		return "", err
-	}
+	entry, err = traced(ctx, "GetConfig", func(ctx context.Context) (metaEntry, error) {
+		oidc, err := e.m.adminClient.GetConfig(ctx)
+		if err != nil {
+			return metaEntry{}, fmt.Errorf("get config: %w", err)
+		}
 
-	err = archive.WriteHeader(&tar.Header{
-		Name: fileConfig,
-		Mode: 0o644,
-		Size: int64(len(oidc)),
+		return spoolEntry(dir, fileConfig, bytes.NewReader(oidc))
 	})
 	if err != nil {
-		return "", err
+		return nil, err
 	}
+	entries = append(entries, entry)
 
-	archive.Write(oidc)
-	return f.Name(), nil
+	return entries, nil
 }
 
-// RestoreMeta restores the additional metadata for an instance, such as IAM configuration, bucket metadata, and OIDC configuration, from a tar.gz archive.
+// Restore restores the additional metadata for an instance, such as IAM configuration, bucket metadata, and OIDC configuration.
 // The archive is expected to contain the following files:
 // - fileIAM: IAM configuration
 // - fileBuckets: Bucket metadata
 // - fileConfig: OIDC configuration
-func (m *Minio) RestoreMeta(ctx context.Context, meta string) error {
-	f, err := os.Open(meta)
-	if err != nil {
-		return err
-	}
-	defer f.Close()
+//
+// Archives exported from other providers only hold the S3 bucket configuration (fileBucketConfig),
+// which is restored through the S3 API instead. In MinIO archives it duplicates fileBuckets, which is preferred.
+func (e MinioExporter) Restore(ctx context.Context, archive MetaArchive, opts RestoreMetaOptions) error {
+	m := e.m
+	if opts.IAM && archive.Has(fileIAM) {
+		f, err := archive.Open(fileIAM)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
 
-	gzr, err := gzip.NewReader(f)
-	if err != nil {
-		return err
+		m.log.Info("restoring iam")
+		if err := m.adminClient.ImportIAM(ctx, f); err != nil {
+			return err
+		}
 	}
-	defer gzr.Close()
 
-	archive := tar.NewReader(gzr)
-
-	for {
-		header, err := archive.Next()
-		if err == io.EOF {
-			break
-		}
+	if opts.Buckets && archive.Has(fileBuckets) {
+		f, err := archive.Open(fileBuckets)
 		if err != nil {
 			return err
 		}
+		defer f.Close()
 
-		switch header.Name {
-		case fileIAM:
-			if err := m.adminClient.ImportIAM(ctx, io.NopCloser(archive)); err != nil {
+		var metadata io.ReadCloser = f
+		if len(opts.OnlyBuckets) > 0 {
+			data, err := io.ReadAll(f)
+			if err != nil {
 				return err
 			}
-		case fileBuckets:
-			resp, err := m.adminClient.ImportBucketMetadata(ctx, "", io.NopCloser(archive))
+
+			data, err = filterBucketZip(data, opts.OnlyBuckets)
 			if err != nil {
-				return err
+				return fmt.Errorf("filter bucket metadata: %w", err)
+			}
+
+			metadata = io.NopCloser(bytes.NewReader(data))
+		}
+
+		m.log.Info("restoring bucket metadata", "buckets", opts.OnlyBuckets)
+		resp, err := m.adminClient.ImportBucketMetadata(ctx, "", metadata)
+		if err != nil {
+			return err
+		}
+
+		for name, value := range resp.Buckets {
+			if value.Err != "" {
+				m.log.Error("failed to import bucket", "bucket", name, "err", value.Err)
+				continue
 			}
 
-			for name, value := range resp.Buckets {
-				if value.Err != "" {
-					m.log.Error("failed to import bucket", "bucket", name, "err", value.Err)
-					continue
-				}
+			m.log.Info("imported bucket", "bucket", name, "value", value)
+		}
+	} else if opts.Buckets && archive.Has(fileBucketConfig) {
+		err := restoreBucketConfig(ctx, m, archive, opts.OnlyBuckets)
+		if err != nil {
+			return err
+		}
+	}
+
+	if opts.Config && archive.Has(fileConfig) {
+		f, err := archive.Open(fileConfig)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
 
-				m.log.Info("imported bucket", "bucket", name, "value", value)
+		var config io.Reader = f
+		if !opts.ConfigFilter.Empty() {
+			data, err := io.ReadAll(f)
+			if err != nil {
+				return err
 			}
 
-		case fileConfig:
-			if err := m.adminClient.SetConfig(ctx, io.NopCloser(archive)); err != nil {
+			filtered, err := opts.ConfigFilter.Apply(string(data), m.log)
+			if err != nil {
 				return err
 			}
+
+			config = strings.NewReader(filtered)
+		}
+
+		m.log.Info("restoring config")
+		if err := m.adminClient.SetConfig(ctx, config); err != nil {
+			return err
 		}
 	}
 
@@ -204,8 +258,15 @@ type BackupBucketOptions struct {
 	Bucket         string
 }
 
-// AssertOrCreateBucket ensures that the specified bucket exists, and if not, creates it with versioning and a lifecycle policy to expire old versions.
-// The bucket will be created with the specified expiration days for old versions. If no expiration days are provided, a default of 7 days will be used.
+// lifecycleRuleID is the ID of the lifecycle rule managed by s32s3 on the backup bucket.
+// Rules with other IDs are left untouched.
+const lifecycleRuleID = "s32s3-noncurrent-expiration"
+
+// AssertOrCreateBucket ensures that the specified bucket exists and reconciles its versioning and lifecycle configuration.
+// Versioning is always enabled, as restoring at a point in time depends on it.
+// Old versions expire after the specified expiration days. If no expiration days are provided, a default of 7 days will be used.
+// Negative expiration days keep old versions forever, removing the managed lifecycle rule if present.
+// Any drift from the desired state, e.g. after changing the expiration days, is corrected and logged.
 func (m *Minio) AssertOrCreateBucket(ctx context.Context, opt BackupBucketOptions) error {
 	log := m.log.With("bucket", opt.Bucket)
 	log.Info("checking if bucket exists")
@@ -216,39 +277,58 @@ func (m *Minio) AssertOrCreateBucket(ctx context.Context, opt BackupBucketOption
 
 	if exists {
 		log.Info("found bucket")
-		return nil
+	} else {
+		log.Info("creating bucket")
+		err = m.client.MakeBucket(ctx, opt.Bucket, minio.MakeBucketOptions{})
+		if err != nil {
+			return err
+		}
 	}
 
-	log.Info("creating bucket")
-	err = m.client.MakeBucket(ctx, opt.Bucket, minio.MakeBucketOptions{})
+	versioning, err := m.client.GetBucketVersioning(ctx, opt.Bucket)
 	if err != nil {
-		return err
+		return fmt.Errorf("get versioning: %w", err)
 	}
 
-	if opt.ExpirationDays < 0 {
-		return nil
+	if !versioning.Enabled() {
+		if exists {
+			log.Warn("correcting drift: versioning is not enabled", "status", versioning.Status)
+		}
+
+		log.Info("enabling versioning")
+		err = m.client.EnableVersioning(ctx, opt.Bucket)
+		if err != nil {
+			return err
+		}
 	}
+
 	if opt.ExpirationDays == 0 {
 		opt.ExpirationDays = 7
 	}
 
-	log.Info("enabling versioning")
-	err = m.client.EnableVersioning(ctx, opt.Bucket)
+	current, err := m.client.GetBucketLifecycle(ctx, opt.Bucket)
 	if err != nil {
-		return err
+		if minio.ToErrorResponse(err).Code != "NoSuchLifecycleConfiguration" {
+			return fmt.Errorf("get lifecycle: %w", err)
+		}
+
+		current = lifecycle.NewConfiguration()
+	}
+
+	desired, drift := reconcileLifecycle(current, opt.ExpirationDays)
+	if len(drift) == 0 {
+		log.Info("lifecycle is up to date")
+		return nil
+	}
+
+	for _, d := range drift {
+		if exists {
+			log.Warn("correcting drift: "+d, "rule", lifecycleRuleID)
+		}
 	}
 
 	log.Info("setting lifecycle")
-	err = m.client.SetBucketLifecycle(ctx, opt.Bucket, &lifecycle.Configuration{
-		Rules: []lifecycle.Rule{
-			{
-				NoncurrentVersionExpiration: lifecycle.NoncurrentVersionExpiration{
-					NoncurrentDays: lifecycle.ExpirationDays(opt.ExpirationDays),
-				},
-				Status: "Enabled",
-			},
-		},
-	})
+	err = m.client.SetBucketLifecycle(ctx, opt.Bucket, desired)
 	if err != nil {
 		return err
 	}
@@ -256,6 +336,81 @@ func (m *Minio) AssertOrCreateBucket(ctx context.Context, opt BackupBucketOption
 	return nil
 }
 
+// reconcileLifecycle returns a copy of the lifecycle configuration with the s32s3 managed rule set to expire noncurrent versions after days.
+// A negative value of days removes the managed rule. All other rules are kept as they are.
+// Rules created by previous versions of s32s3 didn't carry an ID, so they are recognized by their shape and missing or generated ID,
+// and replaced by the managed rule.
+// The returned drift describes the changes made, it is empty if the configuration was already up to date.
+func reconcileLifecycle(current *lifecycle.Configuration, days int) (*lifecycle.Configuration, []string) {
+	var drift []string
+	out := lifecycle.NewConfiguration()
+	found := false
+	for _, rule := range current.Rules {
+		switch {
+		case rule.ID == lifecycleRuleID:
+			found = true
+		case isLegacyLifecycleRule(rule):
+			drift = append(drift, fmt.Sprintf("replacing unnamed expiration rule %q", rule.ID))
+		default:
+			out.Rules = append(out.Rules, rule)
+			continue
+		}
+
+		if days < 0 {
+			drift = append(drift, "removing expiration rule, old versions are kept forever")
+			continue
+		}
+
+		if rule.ID == lifecycleRuleID {
+			if rule.Status != "Enabled" {
+				drift = append(drift, fmt.Sprintf("expiration rule status is %q", rule.Status))
+			}
+
+			if int(rule.NoncurrentVersionExpiration.NoncurrentDays) != days {
+				drift = append(drift, fmt.Sprintf("expiration changed from %d to %d days", rule.NoncurrentVersionExpiration.NoncurrentDays, days))
+			}
+		}
+	}
+
+	if days < 0 {
+		return out, drift
+	}
+
+	if !found {
+		drift = append(drift, "adding expiration rule")
+	}
+
+	out.Rules = append(out.Rules, lifecycle.Rule{
+		ID: lifecycleRuleID,
+		NoncurrentVersionExpiration: lifecycle.NoncurrentVersionExpiration{
+			NoncurrentDays: lifecycle.ExpirationDays(days),
+		},
+		Status: "Enabled",
+	})
+
+	return out, drift
+}
+
+// generatedRuleID matches the IDs MinIO generates for rules created without one, which are xids.
+var generatedRuleID = regexp.MustCompile(`^[0-9a-v]{20}$`)
+
+// isLegacyLifecycleRule reports whether the rule is the unnamed rule created by previous versions of s32s3:
+// a bucket wide rule that only expires noncurrent versions, with no ID or the one generated for it.
+// Rules of the same shape named by users are left alone.
+func isLegacyLifecycleRule(rule lifecycle.Rule) bool {
+	return (rule.ID == "" || generatedRuleID.MatchString(rule.ID)) &&
+		rule.RuleFilter.IsNull() &&
+		rule.Prefix == "" &&
+		!rule.NoncurrentVersionExpiration.IsDaysNull() &&
+		rule.NoncurrentVersionExpiration.NewerNoncurrentVersions == 0 &&
+		rule.Expiration.IsNull() &&
+		rule.DelMarkerExpiration.IsNull() &&
+		rule.AllVersionsExpiration.IsNull() &&
+		rule.AbortIncompleteMultipartUpload.IsDaysNull() &&
+		rule.NoncurrentVersionTransition.IsDaysNull() &&
+		rule.Transition.IsNull()
+}
+
 func NewMinio(logger *slog.Logger, config s3.Options) (*Minio, error) {
 	u, err := url.Parse(config.Endpoint)
 	if err != nil {
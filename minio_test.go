@@ -0,0 +1,68 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+)
+
+func TestReconcileLifecycle(t *testing.T) {
+	other := lifecycle.Rule{
+		ID:         "abort-uploads",
+		RuleFilter: lifecycle.Filter{Prefix: "tmp/"},
+		Expiration: lifecycle.Expiration{Days: 1},
+		Status:     "Enabled",
+	}
+
+	managed := func(days int) lifecycle.Rule {
+		return lifecycle.Rule{
+			ID: lifecycleRuleID,
+			NoncurrentVersionExpiration: lifecycle.NoncurrentVersionExpiration{
+				NoncurrentDays: lifecycle.ExpirationDays(days),
+			},
+			Status: "Enabled",
+		}
+	}
+
+	legacy := managed(7)
+	legacy.ID = "csg2v3v8ld3ejnnkbdpg"
+
+	// same shape as the legacy rule, but named by a user
+	named := managed(30)
+	named.ID = "expire-old-versions"
+
+	cases := []struct {
+		name  string
+		rules []lifecycle.Rule
+		days  int
+		drift bool
+		want  []lifecycle.Rule
+	}{
+		{"empty", nil, 7, true, []lifecycle.Rule{managed(7)}},
+		{"up to date", []lifecycle.Rule{other, managed(7)}, 7, false, []lifecycle.Rule{other, managed(7)}},
+		{"changed days", []lifecycle.Rule{managed(7), other}, 30, true, []lifecycle.Rule{other, managed(30)}},
+		{"legacy", []lifecycle.Rule{legacy, other}, 7, true, []lifecycle.Rule{other, managed(7)}},
+		{"named", []lifecycle.Rule{named, managed(7)}, 7, false, []lifecycle.Rule{named, managed(7)}},
+		{"disabled", []lifecycle.Rule{other, managed(7)}, -1, true, []lifecycle.Rule{other}},
+		{"disabled without rule", []lifecycle.Rule{other}, -1, false, []lifecycle.Rule{other}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out, drift := reconcileLifecycle(&lifecycle.Configuration{Rules: c.rules}, c.days)
+			if (len(drift) > 0) != c.drift {
+				t.Errorf("unexpected drift: %v", drift)
+			}
+
+			if len(out.Rules) != len(c.want) {
+				t.Fatalf("expected %d rules, got %d", len(c.want), len(out.Rules))
+			}
+
+			for i, rule := range out.Rules {
+				if rule.ID != c.want[i].ID || rule.NoncurrentVersionExpiration.NoncurrentDays != c.want[i].NoncurrentVersionExpiration.NoncurrentDays {
+					t.Errorf("rule %d: expected %+v, got %+v", i, c.want[i], rule)
+				}
+			}
+		})
+	}
+}
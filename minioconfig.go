@@ -0,0 +1,165 @@
+package main
+
+import (
+	"fmt"
+	"log/slog"
+	"path"
+	"strings"
+
+	"github.com/minio/madmin-go/v3"
+)
+
+// ConfigFilter selects and rewrites the MinIO server configuration before it is restored,
+// to leave out or adjust settings specific to the environment of the backed up instance.
+type ConfigFilter struct {
+	// Include is a comma separated list of subsystems to restore, all are restored if empty.
+	Include string `config:"INCLUDE"`
+	// Exclude is a comma separated list of subsystems not to restore.
+	Exclude string `config:"EXCLUDE"`
+	// Set holds rewrite rules in the format of the config itself, one `subsys[:target] key=value ...` per line.
+	// The keys are set on the matching subsystem, which is added if it doesn't exist.
+	// Rules for subsystems left out by Include or Exclude are ignored.
+	Set string `config:"SET"`
+}
+
+// Empty reports whether the filter leaves the config unchanged.
+func (f ConfigFilter) Empty() bool {
+	return f.Include == "" && f.Exclude == "" && f.Set == ""
+}
+
+// Merge returns the filter with the fields set in other taking precedence.
+func (f ConfigFilter) Merge(other ConfigFilter) ConfigFilter {
+	if other.Include != "" {
+		f.Include = other.Include
+	}
+
+	if other.Exclude != "" {
+		f.Exclude = other.Exclude
+	}
+
+	if other.Set != "" {
+		f.Set = other.Set
+	}
+
+	return f
+}
+
+// Apply filters and rewrites the config, as returned by GetConfig.
+func (f ConfigFilter) Apply(config string, log *slog.Logger) (string, error) {
+	subsystems, err := madmin.ParseServerConfigOutput(config)
+	if err != nil {
+		return "", fmt.Errorf("parse config: %w", err)
+	}
+
+	include := splitList(f.Include)
+	exclude := splitList(f.Exclude)
+
+	selected := func(s madmin.SubsysConfig) bool {
+		if len(include) > 0 && !matchSubsys(include, s) {
+			log.Info("skipping config subsystem, not included", "subsys", subsysName(s))
+			return false
+		}
+
+		if matchSubsys(exclude, s) {
+			log.Info("skipping config subsystem, excluded", "subsys", subsysName(s))
+			return false
+		}
+
+		return true
+	}
+
+	var out []madmin.SubsysConfig
+	for _, s := range subsystems {
+		if selected(s) {
+			out = append(out, s)
+		}
+	}
+
+	rules, err := madmin.ParseServerConfigOutput(f.Set)
+	if err != nil {
+		return "", fmt.Errorf("parse config rewrite rules: %w", err)
+	}
+
+	for _, rule := range rules {
+		if !selected(rule) {
+			continue
+		}
+
+		i := 0
+		for ; i < len(out); i++ {
+			if out[i].SubSystem == rule.SubSystem && out[i].Target == rule.Target {
+				break
+			}
+		}
+
+		if i == len(out) {
+			out = append(out, madmin.SubsysConfig{SubSystem: rule.SubSystem, Target: rule.Target})
+		}
+
+		for _, kv := range rule.KV {
+			log.Info("rewriting config", "subsys", subsysName(rule), "key", kv.Key)
+			out[i].AddConfigKV(madmin.ConfigKV{Key: kv.Key, Value: kv.Value})
+		}
+	}
+
+	return encodeSubsysConfigs(out), nil
+}
+
+// encodeSubsysConfigs writes the configs in the format accepted by SetConfig.
+// Keys only known from environment variables of the backed up instance are left out.
+func encodeSubsysConfigs(configs []madmin.SubsysConfig) string {
+	b := strings.Builder{}
+	for _, c := range configs {
+		b.WriteString(subsysName(c))
+		for _, kv := range c.KV {
+			if kv.EnvOverride != nil && kv.Value == "" {
+				continue
+			}
+
+			value := kv.Value
+			if value == "" || madmin.HasSpace(value) {
+				value = `"` + value + `"`
+			}
+
+			fmt.Fprintf(&b, " %s=%s", kv.Key, value)
+		}
+		b.WriteString("\n")
+	}
+
+	return b.String()
+}
+
+func subsysName(c madmin.SubsysConfig) string {
+	if c.Target == "" {
+		return c.SubSystem
+	}
+
+	return c.SubSystem + madmin.SubSystemSeparator + c.Target
+}
+
+// matchSubsys reports whether the subsystem matches any of the patterns,
+// which are globs matched against both `subsys` and `subsys:target`.
+func matchSubsys(patterns []string, c madmin.SubsysConfig) bool {
+	for _, p := range patterns {
+		for _, name := range []string{c.SubSystem, subsysName(c)} {
+			if ok, _ := path.Match(p, name); ok {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// splitList splits a comma separated list, ignoring empty items.
+func splitList(s string) []string {
+	var out []string
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item != "" {
+			out = append(out, item)
+		}
+	}
+
+	return out
+}
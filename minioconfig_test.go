@@ -0,0 +1,81 @@
+package main
+
+import (
+	"io"
+	"log/slog"
+	"testing"
+)
+
+func TestConfigFilterApply(t *testing.T) {
+	config := `# region is deprecated
+site name=eu-1 region=eu-west-1
+identity_openid config_url=https://old.example.com/.well-known/openid-configuration client_id=minio display_name="Old SSO"
+# MINIO_NOTIFY_WEBHOOK_ENDPOINT_PRIMARY=http://hook
+notify_webhook:primary endpoint=http://hook queue_limit=0
+api requests_max=0
+`
+
+	cases := []struct {
+		name   string
+		filter ConfigFilter
+		want   string
+	}{
+		{
+			name:   "unchanged",
+			filter: ConfigFilter{},
+			want: `site name=eu-1 region=eu-west-1
+identity_openid config_url=https://old.example.com/.well-known/openid-configuration client_id=minio display_name="Old SSO"
+notify_webhook:primary endpoint=http://hook queue_limit=0
+api requests_max=0
+`,
+		},
+		{
+			name:   "exclude",
+			filter: ConfigFilter{Exclude: "site, notify_*"},
+			want: `identity_openid config_url=https://old.example.com/.well-known/openid-configuration client_id=minio display_name="Old SSO"
+api requests_max=0
+`,
+		},
+		{
+			name:   "include",
+			filter: ConfigFilter{Include: "api,notify_webhook:primary"},
+			want: `notify_webhook:primary endpoint=http://hook queue_limit=0
+api requests_max=0
+`,
+		},
+		{
+			name: "rewrite",
+			filter: ConfigFilter{
+				Exclude: "notify_*,api",
+				Set:     "identity_openid config_url=https://new.example.com/.well-known/openid-configuration?a=1;b=2\nsite name=\"eu 2\"\nregion name=eu",
+			},
+			want: `site name="eu 2" region=eu-west-1
+identity_openid config_url=https://new.example.com/.well-known/openid-configuration?a=1;b=2 client_id=minio display_name="Old SSO"
+region name=eu
+`,
+		},
+		{
+			name: "rewrite filtered",
+			filter: ConfigFilter{
+				Include: "identity_openid",
+				Set:     "identity_openid client_id=s32s3\nsite name=eu-2\nnotify_webhook:primary endpoint=http://new-hook",
+			},
+			want: `identity_openid config_url=https://old.example.com/.well-known/openid-configuration client_id=s32s3 display_name="Old SSO"
+`,
+		},
+	}
+
+	log := slog.New(slog.NewTextHandler(io.Discard, nil))
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			got, err := c.filter.Apply(config, log)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if got != c.want {
+				t.Errorf("expected:\n%s\ngot:\n%s", c.want, got)
+			}
+		})
+	}
+}
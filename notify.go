@@ -0,0 +1,273 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"slices"
+	"strings"
+	"text/template"
+	"time"
+)
+
+const (
+	webhookJSON         = "json"
+	webhookSlack        = "slack"
+	webhookAlertmanager = "alertmanager"
+)
+
+const (
+	notifySuccess = "success"
+	notifyPartial = "partial"
+	notifyFailure = "failure"
+)
+
+// webhookTimeout limits the time to deliver a notification to a webhook.
+const webhookTimeout = 10 * time.Second
+
+// defaultNotifyTemplate is the text of Slack notifications and the description of Alertmanager alerts.
+const defaultNotifyTemplate = `s32s3 {{ .Operation }} {{ .Status }}{{ with .ID }} ({{ . }}){{ end }} after {{ .Duration }}` +
+	`{{ with .Error }}: {{ . }}{{ end }}` +
+	`{{ range .Failed }}
+- {{ .Name }}: {{ .Error }}{{ end }}`
+
+// notifyFuncs are the functions available in webhook templates.
+var notifyFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// Notification is the summary of a backup or restore posted to webhooks.
+type Notification struct {
+	Operation  string      `json:"operation"`
+	Status     string      `json:"status"`
+	ID         string      `json:"id,omitempty"`
+	StartedAt  time.Time   `json:"startedAt"`
+	FinishedAt time.Time   `json:"finishedAt"`
+	Duration   string      `json:"duration"`
+	Buckets    []BucketRun `json:"buckets"`
+	Error      string      `json:"error,omitempty"`
+}
+
+// NewNotification summarizes an operation. It failed if err is set, and partially failed if any bucket did.
+func NewNotification(operation, id string, startedAt time.Time, buckets []BucketRun, err error) Notification {
+	finishedAt := time.Now().UTC()
+	n := Notification{
+		Operation:  operation,
+		Status:     notifySuccess,
+		ID:         id,
+		StartedAt:  startedAt.UTC(),
+		FinishedAt: finishedAt,
+		Duration:   finishedAt.Sub(startedAt).Round(time.Second).String(),
+		Buckets:    buckets,
+	}
+
+	if len(failedBuckets(buckets)) > 0 {
+		n.Status = notifyPartial
+	}
+
+	if err != nil {
+		n.Status = notifyFailure
+		n.Error = err.Error()
+	}
+
+	return n
+}
+
+// Failed returns the buckets that failed.
+func (n Notification) Failed() []BucketRun {
+	var out []BucketRun
+	for _, b := range n.Buckets {
+		if b.Error != "" {
+			out = append(out, b)
+		}
+	}
+
+	return out
+}
+
+// Webhook receives notifications of backups and restores.
+type Webhook struct {
+	// Type is the payload format: json for the notification itself, slack or alertmanager.
+	Type string `json:"type"`
+	URL  string `json:"url"`
+	// Template is a Go text template rendered with the Notification. It replaces the whole body of json webhooks,
+	// the text of slack webhooks and the description of alertmanager alerts.
+	// Values are rendered as is, the json function encodes them as JSON values in the body of json webhooks.
+	Template string `json:"template,omitempty"`
+	// On lists the statuses to notify: success, partial or failure. All are notified if empty.
+	On []string `json:"on,omitempty"`
+
+	tmpl *template.Template
+}
+
+// Webhooks are the webhooks to notify.
+type Webhooks []Webhook
+
+// ParseWebhooks parses webhooks from JSON, such as `[{"type": "slack", "url": "https://hooks.slack.com/...", "on": ["failure"]}]`.
+func ParseWebhooks(s string) (Webhooks, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	var out Webhooks
+	if err := json.Unmarshal([]byte(s), &out); err != nil {
+		return nil, fmt.Errorf("parse webhooks: %w", err)
+	}
+
+	for i := range out {
+		w := &out[i]
+		switch w.Type {
+		case webhookJSON, webhookSlack, webhookAlertmanager:
+		default:
+			return nil, fmt.Errorf("webhook %d: invalid type %q, expected %s, %s or %s", i, w.Type, webhookJSON, webhookSlack, webhookAlertmanager)
+		}
+
+		if w.URL == "" {
+			return nil, fmt.Errorf("webhook %d: url is required", i)
+		}
+
+		for _, status := range w.On {
+			if !slices.Contains([]string{notifySuccess, notifyPartial, notifyFailure}, status) {
+				return nil, fmt.Errorf("webhook %d: invalid status %q", i, status)
+			}
+		}
+
+		text := w.Template
+		if text == "" && w.Type != webhookJSON {
+			text = defaultNotifyTemplate
+		}
+
+		if text != "" {
+			tmpl, err := template.New(w.Type).Funcs(notifyFuncs).Parse(text)
+			if err != nil {
+				return nil, fmt.Errorf("webhook %d: parse template: %w", i, err)
+			}
+			w.tmpl = tmpl
+		}
+	}
+
+	return out, nil
+}
+
+func (w Webhook) render(n Notification) (string, error) {
+	var buf strings.Builder
+	if err := w.tmpl.Execute(&buf, n); err != nil {
+		return "", fmt.Errorf("render template: %w", err)
+	}
+
+	return buf.String(), nil
+}
+
+// Payload returns the body posted to the webhook for the notification.
+func (w Webhook) Payload(n Notification) ([]byte, error) {
+	switch w.Type {
+	case webhookSlack:
+		text, err := w.render(n)
+		if err != nil {
+			return nil, err
+		}
+
+		return json.Marshal(map[string]string{"text": text})
+
+	case webhookAlertmanager:
+		description, err := w.render(n)
+		if err != nil {
+			return nil, err
+		}
+
+		// a successful operation resolves the alert of a previous failure
+		alert := map[string]any{
+			"labels": map[string]string{
+				"alertname": "S32S3OperationFailed",
+				"operation": n.Operation,
+				"severity":  "critical",
+			},
+			"annotations": map[string]string{
+				"summary":     fmt.Sprintf("s32s3 %s %s", n.Operation, n.Status),
+				"description": description,
+			},
+			"startsAt": n.StartedAt,
+		}
+		if n.Status == notifySuccess {
+			alert["endsAt"] = n.FinishedAt
+		}
+
+		return json.Marshal([]any{alert})
+
+	default:
+		if w.tmpl == nil {
+			return json.Marshal(n)
+		}
+
+		body, err := w.render(n)
+		return []byte(body), err
+	}
+}
+
+// Notify posts the notification to the webhooks subscribed to its status.
+// It's delivered even if the context is canceled, as canceled operations are notified as well.
+func (ws Webhooks) Notify(ctx context.Context, n Notification, log *slog.Logger) error {
+	ctx = context.WithoutCancel(ctx)
+	var errs []error
+	for _, w := range ws {
+		if len(w.On) > 0 && !slices.Contains(w.On, n.Status) {
+			continue
+		}
+
+		if err := w.post(ctx, n); err != nil {
+			log.Error("failed to notify webhook", "type", w.Type, "err", err)
+			errs = append(errs, err)
+			continue
+		}
+
+		log.Info("notified webhook", "type", w.Type, "status", n.Status)
+	}
+
+	return errors.Join(errs...)
+}
+
+func (w Webhook) post(ctx context.Context, n Notification) error {
+	body, err := w.Payload(n)
+	if err != nil {
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, webhookTimeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode/100 != 2 {
+		return fmt.Errorf("webhook returned %s", res.Status)
+	}
+
+	return nil
+}
+
+// notify posts the notification to the webhooks of the configuration. Failing to notify doesn't fail the operation.
+func notify(ctx context.Context, config BackupConfig, n Notification, log *slog.Logger) {
+	webhooks, err := ParseWebhooks(config.Webhooks)
+	if err != nil {
+		log.Error("invalid webhooks", "err", err)
+		return
+	}
+
+	webhooks.Notify(ctx, n, log)
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestNewNotification(t *testing.T) {
+	start := time.Now().Add(-time.Minute)
+	ok := []BucketRun{{Name: "a"}}
+	failed := []BucketRun{{Name: "a"}, {Name: "b", Error: "exit status 5"}}
+
+	for _, test := range []struct {
+		buckets []BucketRun
+		err     error
+		status  string
+	}{
+		{ok, nil, notifySuccess},
+		{failed, nil, notifyPartial},
+		{failed, errors.New("write run"), notifyFailure},
+	} {
+		n := NewNotification(operationBackup, "20240101T000000Z", start, test.buckets, test.err)
+		if n.Status != test.status {
+			t.Errorf("expected %s, got %s", test.status, n.Status)
+		}
+	}
+}
+
+func TestWebhooksNotify(t *testing.T) {
+	var mu sync.Mutex
+	bodies := map[string][]byte{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		mu.Lock()
+		bodies[r.URL.Path] = body
+		mu.Unlock()
+		if r.URL.Path == "/broken" {
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}))
+	defer server.Close()
+
+	webhooks, err := ParseWebhooks(`[
+		{"type": "json", "url": "` + server.URL + `/json"},
+		{"type": "slack", "url": "` + server.URL + `/slack"},
+		{"type": "alertmanager", "url": "` + server.URL + `/alertmanager"},
+		{"type": "json", "url": "` + server.URL + `/templated", "template": "{\"text\": {{ printf \"%s %s\" .Operation .Status | json }}, \"failed\": {{ json .Failed }}}"},
+		{"type": "slack", "url": "` + server.URL + `/success", "on": ["success"]}
+	]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	n := NewNotification(operationBackup, "20240101T000000Z", time.Now(), []BucketRun{
+		{Name: "a", Duration: "1s"},
+		{Name: "b", Duration: "2s", Error: "exit status 5: \"b\"\nnot found"},
+	}, nil)
+	if err := webhooks.Notify(context.Background(), n, slog.Default()); err != nil {
+		t.Fatal(err)
+	}
+
+	var generic Notification
+	if err := json.Unmarshal(bodies["/json"], &generic); err != nil {
+		t.Fatal(err)
+	}
+	if generic.Status != notifyPartial || len(generic.Buckets) != 2 || generic.Buckets[1].Duration != "2s" {
+		t.Errorf("unexpected json payload %s", bodies["/json"])
+	}
+
+	var slack struct{ Text string }
+	if err := json.Unmarshal(bodies["/slack"], &slack); err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(slack.Text, "backup partial (20240101T000000Z)") || !strings.Contains(slack.Text, "- b: exit status 5: \"b\"") {
+		t.Errorf("unexpected slack text %q", slack.Text)
+	}
+
+	var alerts []struct {
+		Labels map[string]string
+		EndsAt *time.Time
+	}
+	if err := json.Unmarshal(bodies["/alertmanager"], &alerts); err != nil {
+		t.Fatal(err)
+	}
+	if len(alerts) != 1 || alerts[0].Labels["operation"] != operationBackup || alerts[0].EndsAt != nil {
+		t.Errorf("unexpected alertmanager payload %s", bodies["/alertmanager"])
+	}
+
+	var templated struct {
+		Text   string
+		Failed []BucketRun
+	}
+	if err := json.Unmarshal(bodies["/templated"], &templated); err != nil {
+		t.Fatalf("invalid templated payload %s: %v", bodies["/templated"], err)
+	}
+	if templated.Text != "backup partial" || len(templated.Failed) != 1 || templated.Failed[0].Error != n.Buckets[1].Error {
+		t.Errorf("unexpected templated payload %s", bodies["/templated"])
+	}
+
+	if _, ok := bodies["/success"]; ok {
+		t.Error("expected webhook subscribed to success only not to be notified")
+	}
+
+	broken, err := ParseWebhooks(`[{"type": "json", "url": "` + server.URL + `/broken"}]`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := broken.Notify(context.Background(), n, slog.Default()); err == nil {
+		t.Error("expected error from failing webhook")
+	}
+}
+
+func TestParseWebhooks(t *testing.T) {
+	for _, s := range []string{
+		`{}`,
+		`[{"type": "teams", "url": "http://localhost"}]`,
+		`[{"type": "json"}]`,
+		`[{"type": "json", "url": "http://localhost", "on": ["failed"]}]`,
+		`[{"type": "slack", "url": "http://localhost", "template": "{{ .Status"}]`,
+	} {
+		if _, err := ParseWebhooks(s); err == nil {
+			t.Errorf("expected error parsing %s", s)
+		}
+	}
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path"
+
+	"github.com/rclone/rclone/fs"
+)
+
+// ObjectFilter selects the objects of a bucket to back up, it's passed to rclone as filter flags.
+// Patterns use the rclone filter syntax and are relative to the root of the bucket, such as `tmp/**` or `*.partial`.
+type ObjectFilter struct {
+	// Include lists the objects to back up, all are backed up if empty.
+	Include []string `json:"include,omitempty"`
+	// Exclude lists the objects not to back up, it takes precedence over Include.
+	Exclude []string `json:"exclude,omitempty"`
+	// MinSize and MaxSize limit the size of backed up objects, with suffixes such as 10M or 1G.
+	MinSize string `json:"minSize,omitempty"`
+	MaxSize string `json:"maxSize,omitempty"`
+	// MaxAge limits the age of backed up objects, as a duration such as 30d or a date.
+	MaxAge string `json:"maxAge,omitempty"`
+}
+
+// Validate checks the sizes and age of the filter.
+func (f ObjectFilter) Validate() error {
+	for _, size := range []string{f.MinSize, f.MaxSize} {
+		if size == "" {
+			continue
+		}
+
+		var s fs.SizeSuffix
+		if err := s.Set(size); err != nil {
+			return fmt.Errorf("invalid size %q: %w", size, err)
+		}
+	}
+
+	if f.MaxAge != "" {
+		if _, err := fs.ParseDuration(f.MaxAge); err != nil {
+			return fmt.Errorf("invalid max age %q: %w", f.MaxAge, err)
+		}
+	}
+
+	return nil
+}
+
+// Args returns the rclone flags applying the filter.
+// Patterns are passed as ordered filter rules, so that excludes win over includes.
+func (f ObjectFilter) Args() []string {
+	var args []string
+	for _, p := range f.Exclude {
+		args = append(args, "--filter", "- "+p)
+	}
+
+	for _, p := range f.Include {
+		args = append(args, "--filter", "+ "+p)
+	}
+
+	if len(f.Include) > 0 {
+		args = append(args, "--filter", "- **")
+	}
+
+	if f.MinSize != "" {
+		args = append(args, "--min-size", f.MinSize)
+	}
+
+	if f.MaxSize != "" {
+		args = append(args, "--max-size", f.MaxSize)
+	}
+
+	if f.MaxAge != "" {
+		args = append(args, "--max-age", f.MaxAge)
+	}
+
+	return args
+}
+
+// ObjectFilters maps bucket names or globs to the object filter applied to them.
+type ObjectFilters map[string]ObjectFilter
+
+// ParseObjectFilters parses object filters from JSON, such as `{"logs": {"exclude": ["tmp/**"], "maxSize": "1G"}}`.
+func ParseObjectFilters(s string) (ObjectFilters, error) {
+	if s == "" {
+		return nil, nil
+	}
+
+	out := ObjectFilters{}
+	if err := json.Unmarshal([]byte(s), &out); err != nil {
+		return nil, fmt.Errorf("parse object filters: %w", err)
+	}
+
+	for bucket, f := range out {
+		if _, err := path.Match(bucket, ""); err != nil {
+			return nil, fmt.Errorf("object filter %q: invalid glob: %w", bucket, err)
+		}
+
+		if err := f.Validate(); err != nil {
+			return nil, fmt.Errorf("object filter %q: %w", bucket, err)
+		}
+	}
+
+	return out, nil
+}
+
+// For returns the filter of the bucket, or nil if it isn't filtered.
+// An exact match of the bucket name wins over globs, and the most specific matching glob over the others,
+// so that `logs-*` wins over `*`. Globs as specific as each other are tried in lexical order.
+func (f ObjectFilters) For(bucket string) *ObjectFilter {
+	if filter, ok := f[bucket]; ok {
+		return &filter
+	}
+
+	match, specificity := "", -1
+	for _, k := range mapKeys(f) {
+		if ok, _ := path.Match(k, bucket); ok && globSpecificity(k) > specificity {
+			match, specificity = k, globSpecificity(k)
+		}
+	}
+
+	if specificity < 0 {
+		return nil
+	}
+
+	filter := f[match]
+	return &filter
+}
+
+// globSpecificity returns the number of characters a glob matches literally, counting character classes as one.
+func globSpecificity(glob string) int {
+	n := 0
+	for i := 0; i < len(glob); i++ {
+		switch glob[i] {
+		case '*', '?':
+		case '[':
+			for i < len(glob) && glob[i] != ']' {
+				i++
+			}
+			n++
+		case '\\':
+			i++
+			n++
+		default:
+			n++
+		}
+	}
+
+	return n
+}
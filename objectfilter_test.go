@@ -0,0 +1,45 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestObjectFilters(t *testing.T) {
+	filters, err := ParseObjectFilters(`{
+		"logs": {"exclude": ["tmp/**"], "include": ["*.gz"], "maxSize": "1G"},
+		"logs-*": {"maxAge": "30d"},
+		"*": {"minSize": "1k"}
+	}`)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"--filter", "- tmp/**", "--filter", "+ *.gz", "--filter", "- **", "--max-size", "1G"}
+	if got := filters.For("logs").Args(); !slices.Equal(got, want) {
+		t.Errorf("expected %q, got %q", want, got)
+	}
+
+	// "*" sorts before "logs-*", but "logs-*" is more specific.
+	if f := filters.For("logs-2024"); f == nil || f.MaxAge != "30d" {
+		t.Errorf("expected the logs-* filter, got %+v", f)
+	}
+
+	if f := filters.For("data"); f == nil || f.MinSize != "1k" {
+		t.Errorf("expected the * filter, got %+v", f)
+	}
+
+	for glob, want := range map[string]int{"*": 0, "logs-*": 5, "logs-?": 5, "log[sz]-*": 5, `logs\*`: 5} {
+		if got := globSpecificity(glob); got != want {
+			t.Errorf("expected specificity %d for %s, got %d", want, glob, got)
+		}
+	}
+
+	if f := (ObjectFilters{"logs-*": {}}).For("data"); f != nil {
+		t.Errorf("expected no filter, got %+v", f)
+	}
+
+	if _, err := ParseObjectFilters(`{"logs": {"maxSize": "big"}}`); err == nil {
+		t.Error("expected error for invalid size")
+	}
+}
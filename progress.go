@@ -0,0 +1,278 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"maps"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+)
+
+// rcloneStatsInterval is how often rclone reports the stats of a running command.
+const rcloneStatsInterval = "5s"
+
+// rcloneStats are the stats rclone reports in its JSON log.
+// https://rclone.org/rc/#core-stats
+type rcloneStats struct {
+	Bytes          int64   `json:"bytes"`
+	TotalBytes     int64   `json:"totalBytes"`
+	Transfers      int64   `json:"transfers"`
+	TotalTransfers int64   `json:"totalTransfers"`
+	Checks         int64   `json:"checks"`
+	Deletes        int64   `json:"deletes"`
+	Errors         int64   `json:"errors"`
+	Speed          float64 `json:"speed"`
+}
+
+// statsWriter passes the log of rclone through to out, except for the stats, which are handed to fn.
+// It expects the JSON log enabled by --use-json-log.
+type statsWriter struct {
+	out io.Writer
+	fn  func(rcloneStats)
+	buf []byte
+}
+
+func (w *statsWriter) Write(p []byte) (int, error) {
+	w.buf = append(w.buf, p...)
+	for {
+		i := bytes.IndexByte(w.buf, '\n')
+		if i < 0 {
+			break
+		}
+
+		w.line(w.buf[:i+1])
+		w.buf = w.buf[i+1:]
+	}
+
+	return len(p), nil
+}
+
+// Flush passes through the last line, if it isn't terminated.
+func (w *statsWriter) Flush() {
+	if len(w.buf) > 0 {
+		w.line(w.buf)
+		w.buf = nil
+	}
+}
+
+func (w *statsWriter) line(line []byte) {
+	var entry struct {
+		Stats *rcloneStats `json:"stats"`
+	}
+	if json.Unmarshal(line, &entry) == nil && entry.Stats != nil {
+		w.fn(*entry.Stats)
+		return
+	}
+
+	w.out.Write(line)
+}
+
+// ProgressConfig configures the progress reporting of backup runs.
+type ProgressConfig struct {
+	// Interval is how often the progress is logged.
+	Interval string `config:"INTERVAL"`
+	// Listen is the address to serve the progress on over HTTP, if set.
+	Listen string `config:"LISTEN"`
+}
+
+const (
+	bucketRunning = "running"
+	bucketDone    = "done"
+	bucketFailed  = "failed"
+)
+
+// Progress aggregates the progress of the buckets synced during a run.
+type Progress struct {
+	mu        sync.Mutex
+	startedAt time.Time
+	buckets   int
+	stats     map[string]rcloneStats
+	started   map[string]bool
+	done      map[string]bool
+	errors    map[string]string
+}
+
+// BucketProgress is the state of a bucket started during a run: running, done or failed.
+type BucketProgress struct {
+	Name       string `json:"name"`
+	State      string `json:"state"`
+	Bytes      int64  `json:"bytes"`
+	TotalBytes int64  `json:"totalBytes"`
+	Error      string `json:"error,omitempty"`
+}
+
+// ProgressSnapshot is the progress of a run at some point.
+// Bytes and objects only account for the buckets started so far, as the size of the others is unknown yet.
+type ProgressSnapshot struct {
+	StartedAt    time.Time `json:"startedAt"`
+	Buckets      int       `json:"buckets"`
+	BucketsDone  int       `json:"bucketsDone"`
+	Active       []string  `json:"active"`
+	Bytes        int64     `json:"bytes"`
+	TotalBytes   int64     `json:"totalBytes"`
+	Objects      int64     `json:"objects"`
+	TotalObjects int64     `json:"totalObjects"`
+	Errors       int64     `json:"errors"`
+	// Speed is the current throughput in bytes per second.
+	Speed float64 `json:"speed"`
+	// ETA is the estimated time until the started buckets are synced, if anything is being transferred.
+	ETA string `json:"eta,omitempty"`
+	// BucketStates lists the state of each bucket started so far.
+	BucketStates []BucketProgress `json:"bucketStates"`
+}
+
+// NewProgress returns a progress to track a run with.
+func NewProgress() *Progress {
+	return &Progress{
+		stats:   map[string]rcloneStats{},
+		started: map[string]bool{},
+		done:    map[string]bool{},
+		errors:  map[string]string{},
+	}
+}
+
+// Begin starts tracking a run syncing the specified number of buckets.
+func (p *Progress) Begin(startedAt time.Time, buckets int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.startedAt = startedAt
+	p.buckets = buckets
+}
+
+// Update records the latest stats of a bucket.
+func (p *Progress) Update(bucket string, stats rcloneStats) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stats[bucket] = stats
+}
+
+// Bucket returns the latest stats of a bucket.
+func (p *Progress) Bucket(bucket string) rcloneStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.stats[bucket]
+}
+
+// Start marks a bucket as running.
+func (p *Progress) Start(bucket string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.started[bucket] = true
+}
+
+// Done marks a bucket as finished, and as failed if err isn't empty.
+func (p *Progress) Done(bucket string, err string) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.started[bucket] = true
+	p.done[bucket] = true
+	if err != "" {
+		p.errors[bucket] = err
+	}
+}
+
+// Snapshot returns the aggregated progress of all buckets.
+func (p *Progress) Snapshot() ProgressSnapshot {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	out := ProgressSnapshot{
+		StartedAt:    p.startedAt,
+		Buckets:      p.buckets,
+		BucketsDone:  len(p.done),
+		Active:       []string{},
+		BucketStates: []BucketProgress{},
+	}
+
+	buckets := slices.Collect(maps.Keys(p.started))
+	for bucket := range p.stats {
+		if !p.started[bucket] {
+			buckets = append(buckets, bucket)
+		}
+	}
+	slices.Sort(buckets)
+
+	for _, bucket := range buckets {
+		s := p.stats[bucket]
+		out.Bytes += s.Bytes
+		out.TotalBytes += s.TotalBytes
+		out.Objects += s.Transfers
+		out.TotalObjects += s.TotalTransfers
+		out.Errors += s.Errors
+
+		state := BucketProgress{Name: bucket, State: bucketRunning, Bytes: s.Bytes, TotalBytes: s.TotalBytes, Error: p.errors[bucket]}
+		switch {
+		case p.errors[bucket] != "":
+			state.State = bucketFailed
+		case p.done[bucket]:
+			state.State = bucketDone
+		default:
+			out.Active = append(out.Active, bucket)
+			out.Speed += s.Speed
+		}
+		out.BucketStates = append(out.BucketStates, state)
+	}
+
+	if remaining := out.TotalBytes - out.Bytes; out.Speed > 0 && remaining > 0 {
+		out.ETA = (time.Duration(float64(remaining)/out.Speed) * time.Second).Round(time.Second).String()
+	}
+
+	return out
+}
+
+// Report logs the progress every interval, until the context is done.
+func (p *Progress) Report(ctx context.Context, log *slog.Logger, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		s := p.Snapshot()
+		log.Info("progress",
+			"buckets", s.Buckets,
+			"bucketsDone", s.BucketsDone,
+			"active", s.Active,
+			"bytes", s.Bytes,
+			"totalBytes", s.TotalBytes,
+			"objects", s.Objects,
+			"totalObjects", s.TotalObjects,
+			"errors", s.Errors,
+			"speed", s.Speed,
+			"eta", s.ETA,
+		)
+	}
+}
+
+// ServeHTTP serves the current progress as JSON.
+func (p *Progress) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p.Snapshot())
+}
+
+// ServeProgress serves the progress on /progress at the address until the context is done.
+func ServeProgress(ctx context.Context, addr string, p *Progress, log *slog.Logger) {
+	mux := http.NewServeMux()
+	mux.Handle("GET /progress", p)
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	log.Info("serving progress", "addr", addr)
+	if err := server.ListenAndServe(); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		log.Error("failed to serve progress", "err", err)
+	}
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http/httptest"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestProgress(t *testing.T) {
+	p := NewProgress()
+	p.Begin(time.Now(), 3)
+
+	var out bytes.Buffer
+	w := &statsWriter{out: &out, fn: func(s rcloneStats) { p.Update("logs", s) }}
+	w.Write([]byte(`{"level":"notice","msg":"copied","source":"operations.go"}` + "\n" + `{"level":"notice","msg":"Transferred","st`))
+	w.Write([]byte(`ats":{"bytes":100,"totalBytes":1100,"transfers":1,"totalTransfers":4,"speed":10}}` + "\n"))
+	w.Write([]byte("not json"))
+	w.Flush()
+
+	if want := `{"level":"notice","msg":"copied","source":"operations.go"}` + "\nnot json"; out.String() != want {
+		t.Errorf("expected stats to be filtered from log, got %q", out.String())
+	}
+
+	p.Update("data", rcloneStats{Bytes: 50, TotalBytes: 50, Transfers: 2, TotalTransfers: 2, Speed: 5})
+	p.Done("data", "")
+	p.Start("media")
+	p.Done("media", "exit status 5")
+
+	s := p.Snapshot()
+	if s.BucketsDone != 2 || !slices.Equal(s.Active, []string{"logs"}) {
+		t.Errorf("expected data and media done and logs active, got %+v", s)
+	}
+
+	want := []BucketProgress{
+		{Name: "data", State: bucketDone, Bytes: 50, TotalBytes: 50},
+		{Name: "logs", State: bucketRunning, Bytes: 100, TotalBytes: 1100},
+		{Name: "media", State: bucketFailed, Error: "exit status 5"},
+	}
+	if !slices.Equal(s.BucketStates, want) {
+		t.Errorf("expected bucket states %+v, got %+v", want, s.BucketStates)
+	}
+
+	if s.Bytes != 150 || s.TotalBytes != 1150 || s.Objects != 3 || s.TotalObjects != 6 || s.Speed != 10 {
+		t.Errorf("unexpected totals %+v", s)
+	}
+
+	if s.ETA != "1m40s" {
+		t.Errorf("expected ETA 1m40s, got %q", s.ETA)
+	}
+
+	rec := httptest.NewRecorder()
+	p.ServeHTTP(rec, httptest.NewRequest("GET", "/progress", nil))
+
+	var served ProgressSnapshot
+	if err := json.NewDecoder(rec.Body).Decode(&served); err != nil {
+		t.Fatal(err)
+	}
+
+	if served.Bytes != s.Bytes || served.ETA != s.ETA {
+		t.Errorf("expected served progress %+v, got %+v", s, served)
+	}
+}
@@ -9,13 +9,19 @@ import (
 	"os"
 	"os/exec"
 	"path/filepath"
+	"strconv"
 	"time"
 )
 
+// rcloneExitDirNotFound is the exit code of rclone when the requested directory doesn't exist.
+// https://rclone.org/docs/#exit-code
+const rcloneExitDirNotFound = 3
+
 // EncodeConfig writes the backup configuration to the provided io.Writer in INI format.
 func EncodeConfig(w io.Writer, c BackupConfig) error {
 	fmt.Fprintf(w, "# backup_bucket = %s\n", c.BackupBucket)
 	fmt.Fprintf(w, "# expiration_days = %d\n", c.ExpirationDays)
+	fmt.Fprintf(w, "# retention = %s\n", c.Retention)
 	if err := c.Source.EncodeIni(w); err != nil {
 		return fmt.Errorf("source: encode ini: %w", err)
 	}
@@ -31,90 +37,184 @@ func EncodeConfig(w io.Writer, c BackupConfig) error {
 	return nil
 }
 
-type SyncBucketOptions struct {
-	Bucket string
-	Source string
-	Dest   string
-	At     *string
-	log    *slog.Logger
+// rcloneCmd is an invocation of the rclone command with the rclone configuration of a BackupConfig.
+type rcloneCmd struct {
+	args []string
+	// remotes are the remotes accessed by the command, selecting the bandwidth limits applied to it.
+	remotes []string
+	// shares is the number of concurrent commands sharing the bandwidth limits.
+	shares int
+	// stdout receives the output of the command when run, os.Stdout if nil.
+	stdout io.Writer
+	// stats receives the stats of the command while it runs, if set.
+	stats func(rcloneStats)
+	log   *slog.Logger
 }
 
-// RcloneSyncBucket syncs the specified source bucket to the specified destination bucket using the rclone command.
-func RcloneSyncBucket(ctx context.Context, config BackupConfig, opts SyncBucketOptions) error {
+// command prepares the command, the returned function removes the temporary rclone configuration.
+func (c rcloneCmd) command(ctx context.Context, config BackupConfig) (*exec.Cmd, func(), error) {
 	f, err := os.CreateTemp("", "rclone.conf")
 	if err != nil {
-		return fmt.Errorf("create temp file: %w", err)
+		return nil, nil, fmt.Errorf("create temp file: %w", err)
 	}
-	defer os.Remove(f.Name())
 	defer f.Close()
+	cleanup := func() { os.Remove(f.Name()) }
+
+	err = EncodeConfig(f, config)
+	if err != nil {
+		cleanup()
+		return nil, nil, fmt.Errorf("build rclone config: %w", err)
+	}
+
+	args := append([]string{c.args[0], "--config", f.Name()}, c.args[1:]...)
+	limit, err := config.Bandwidth.For(c.remotes, c.shares)
+	if err != nil {
+		cleanup()
+		return nil, nil, err
+	}
+	if limit != "" {
+		args = append(args, "--bwlimit", limit)
+	}
+	if c.stats != nil {
+		args = append(args, "--use-json-log", "--stats", rcloneStatsInterval, "--stats-log-level", "NOTICE")
+	}
+
+	c.log.Info("running rclone", "args", args)
+	cmd := exec.CommandContext(ctx, "rclone", args...)
+	cmd.Stderr = os.Stderr
+	return cmd, cleanup, nil
+}
+
+// run runs the command, writing its output to stdout.
+func (c rcloneCmd) run(ctx context.Context, config BackupConfig) error {
+	cmd, cleanup, err := c.command(ctx, config)
+	if err != nil {
+		return err
+	}
+	defer cleanup()
 
+	cmd.Stdout = c.stdout
+	if cmd.Stdout == nil {
+		cmd.Stdout = os.Stdout
+	}
+
+	if c.stats != nil {
+		w := &statsWriter{out: os.Stderr, fn: c.stats}
+		defer w.Flush()
+		cmd.Stderr = w
+	}
+
+	err = cmd.Run()
+	if err != nil {
+		return fmt.Errorf("rclone %s: %w", c.args[0], err)
+	}
+
+	return nil
+}
+
+// output runs the command and returns its output.
+func (c rcloneCmd) output(ctx context.Context, config BackupConfig) ([]byte, error) {
+	cmd, cleanup, err := c.command(ctx, config)
+	if err != nil {
+		return nil, err
+	}
+	defer cleanup()
+
+	data, err := cmd.Output()
+	if err != nil {
+		return nil, fmt.Errorf("rclone %s: %w", c.args[0], err)
+	}
+
+	return data, nil
+}
+
+type SyncBucketOptions struct {
+	Bucket   string
+	Source   string
+	Dest     string
+	At       *string
+	SourceAt *string
+	Filter   *ObjectFilter
+	// Copy only copies new and changed objects, without deleting objects missing from the source.
+	Copy bool
+	// MaxDelete aborts the sync once more objects would be deleted from the destination, if set.
+	MaxDelete *int
+	// Concurrency is the number of buckets synced concurrently, which share the bandwidth limits.
+	Concurrency int
+	// Stats receives the stats of the sync while it runs, if set.
+	Stats func(rcloneStats)
+	log   *slog.Logger
+}
+
+// RcloneSyncBucket syncs the specified source bucket to the specified destination bucket using the rclone command.
+// At selects the version of the backup to read, SourceAt the version of a versioned source bucket.
+// Objects excluded by Filter are neither synced nor deleted from the destination.
+func RcloneSyncBucket(ctx context.Context, config BackupConfig, opts SyncBucketOptions) error {
 	if opts.At != nil {
 		config.Dest.Value.VersionAt.Set(*opts.At)
 	}
-	err = EncodeConfig(f, config)
-	if err != nil {
-		return fmt.Errorf("build rclone config: %w", err)
+	if opts.SourceAt != nil {
+		config.Source.Value.VersionAt.Set(*opts.SourceAt)
+	}
+
+	command := "sync"
+	if opts.Copy {
+		command = "copy"
 	}
 
 	args := []string{
-		"sync",
-		"--config", f.Name(),
+		command,
 		fmt.Sprintf("%s:%s", opts.Source, opts.Bucket),
 		fmt.Sprintf("%s:%s", opts.Dest, opts.Bucket),
 	}
+	if opts.Filter != nil {
+		args = append(args, opts.Filter.Args()...)
+	}
+	if opts.MaxDelete != nil {
+		args = append(args, "--max-delete", strconv.Itoa(*opts.MaxDelete))
+	}
 
-	opts.log.Info("running rclone", "args", args)
-
-	cmd := exec.CommandContext(ctx, "rclone", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	err := rcloneCmd{
+		args:    args,
+		remotes: []string{opts.Source, opts.Dest},
+		shares:  opts.Concurrency,
+		stats:   opts.Stats,
+		log:     opts.log,
+	}.run(ctx, config)
 	if err != nil {
-		return fmt.Errorf("rclone sync: %w", err)
+		return err
 	}
 
-	opts.log.Info("rclone sync complete")
+	opts.log.Info(fmt.Sprintf("rclone %s complete", command))
 	return nil
 }
 
 type SyncFileOptions struct {
 	File string
 	Dest string
+	Dir  string
 	At   *string
 	log  *slog.Logger
 }
 
 // RcloneSyncFile syncs a local file to the specified destination using the rclone command.
+// The file is placed in the root of the destination, unless a directory is specified.
 func RcloneSyncFile(ctx context.Context, config BackupConfig, opts SyncFileOptions) error {
-	f, err := os.CreateTemp("", "rclone.conf")
-	if err != nil {
-		return fmt.Errorf("create temp file: %w", err)
-	}
-	defer os.Remove(f.Name())
-	defer f.Close()
-
 	if opts.At != nil {
 		config.Dest.Value.VersionAt.Set(*opts.At)
 	}
-	err = EncodeConfig(f, config)
-	if err != nil {
-		return fmt.Errorf("build rclone config: %w", err)
-	}
-
-	args := []string{
-		"sync",
-		"--config", f.Name(),
-		opts.File,
-		fmt.Sprintf("%s:", opts.Dest),
-	}
 
-	opts.log.Info("running rclone", "args", args)
-	cmd := exec.CommandContext(ctx, "rclone", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-	err = cmd.Run()
+	err := rcloneCmd{
+		args: []string{
+			"sync",
+			opts.File,
+			fmt.Sprintf("%s:%s", opts.Dest, opts.Dir),
+		},
+		remotes: []string{opts.Dest},
+		log:     opts.log,
+	}.run(ctx, config)
 	if err != nil {
-		return fmt.Errorf("rclone sync: %w", err)
+		return err
 	}
 
 	opts.log.Info("rclone sync complete")
@@ -130,41 +230,26 @@ type DownloadFileOptions struct {
 
 // RcloneDownloadFile downloads a file from the specified source location to a temporary directory.
 func RcloneDownloadFile(ctx context.Context, config BackupConfig, opts DownloadFileOptions) (string, error) {
-	f, err := os.CreateTemp("", "rclone.conf")
-	if err != nil {
-		return "", fmt.Errorf("create temp file: %w", err)
-	}
-	defer os.Remove(f.Name())
-	defer f.Close()
-
 	if opts.At != nil {
 		config.Dest.Value.VersionAt.Set(*opts.At)
 	}
-	err = EncodeConfig(f, config)
-	if err != nil {
-		return "", fmt.Errorf("build rclone config: %w", err)
-	}
 
 	dir, err := os.MkdirTemp("", "s32s3-*")
 	if err != nil {
 		return "", err
 	}
 
-	args := []string{
-		"copy",
-		"--config", f.Name(),
-		fmt.Sprintf("%s:%s", opts.Source, opts.File),
-		dir,
-	}
-
-	opts.log.Info("running rclone", "args", args)
-	cmd := exec.CommandContext(ctx, "rclone", args...)
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	err = cmd.Run()
+	err = rcloneCmd{
+		args: []string{
+			"copy",
+			fmt.Sprintf("%s:%s", opts.Source, opts.File),
+			dir,
+		},
+		remotes: []string{opts.Source},
+		log:     opts.log,
+	}.run(ctx, config)
 	if err != nil {
-		return "", fmt.Errorf("rclone copy: %w", err)
+		return "", err
 	}
 
 	opts.log.Info("rclone copy complete")
@@ -179,34 +264,137 @@ type ListBucketsOptions struct {
 
 // RcloneListBucketsRemote lists the buckets in the specified remote location using the provided BackupConfig and ListBucketsOptions.
 func RcloneListBucketsRemote(ctx context.Context, config BackupConfig, opts ListBucketsOptions) ([]string, error) {
-	f, err := os.CreateTemp("", "rclone.conf")
+	if opts.At != nil {
+		config.Dest.Value.VersionAt.Set(*opts.At)
+	}
+
+	data, err := rcloneCmd{
+		args: []string{
+			"lsjson",
+			fmt.Sprintf("%s:", opts.Remote),
+		},
+		remotes: []string{opts.Remote},
+		log:     opts.log,
+	}.output(ctx, config)
 	if err != nil {
-		return nil, fmt.Errorf("create temp file: %w", err)
+		return nil, err
 	}
-	defer os.Remove(f.Name())
-	defer f.Close()
 
+	var files []FileInfo
+	err = json.Unmarshal(data, &files)
+	if err != nil {
+		return nil, fmt.Errorf("unmarshal json: %w", err)
+	}
+
+	buckets := make([]string, 0, len(files))
+	for _, f := range files {
+		if f.IsBucket && f.Name != stateDir {
+			buckets = append(buckets, f.Name)
+		}
+	}
+
+	opts.log.Info("rclone lsjson complete", "buckets", buckets)
+	return buckets, nil
+}
+
+type CatOptions struct {
+	Path   string
+	Source string
+	At     *string
+	Out    io.Writer
+	log    *slog.Logger
+}
+
+// RcloneCat writes the contents of the specified file to opts.Out using the rclone command.
+// If the path is a directory, the contents of all files in it are concatenated.
+func RcloneCat(ctx context.Context, config BackupConfig, opts CatOptions) error {
 	if opts.At != nil {
 		config.Dest.Value.VersionAt.Set(*opts.At)
 	}
-	err = EncodeConfig(f, config)
+
+	err := rcloneCmd{
+		args: []string{
+			"cat",
+			fmt.Sprintf("%s:%s", opts.Source, opts.Path),
+		},
+		remotes: []string{opts.Source},
+		stdout:  opts.Out,
+		log:     opts.log,
+	}.run(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	opts.log.Info("rclone cat complete")
+	return nil
+}
+
+type DeleteFileOptions struct {
+	File   string
+	Remote string
+	log    *slog.Logger
+}
+
+// RcloneDeleteFile deletes a single file from the specified remote using the rclone command.
+func RcloneDeleteFile(ctx context.Context, config BackupConfig, opts DeleteFileOptions) error {
+	err := rcloneCmd{
+		args: []string{
+			"deletefile",
+			fmt.Sprintf("%s:%s", opts.Remote, opts.File),
+		},
+		remotes: []string{opts.Remote},
+		log:     opts.log,
+	}.run(ctx, config)
 	if err != nil {
-		return nil, fmt.Errorf("build rclone config: %w", err)
+		return err
+	}
+
+	opts.log.Info("rclone deletefile complete")
+	return nil
+}
+
+type ListOptions struct {
+	Path      string
+	Remote    string
+	At        *string
+	SourceAt  *string
+	Recursive bool
+	FilesOnly bool
+	Filter    *ObjectFilter
+	log       *slog.Logger
+}
+
+// RcloneList lists the files and directories at the specified path of the remote using the rclone command.
+// At selects the version of the backup to list, SourceAt the version of a versioned source bucket.
+func RcloneList(ctx context.Context, config BackupConfig, opts ListOptions) ([]FileInfo, error) {
+	if opts.At != nil {
+		config.Dest.Value.VersionAt.Set(*opts.At)
+	}
+	if opts.SourceAt != nil {
+		config.Source.Value.VersionAt.Set(*opts.SourceAt)
 	}
 
 	args := []string{
 		"lsjson",
-		"--config", f.Name(),
-		fmt.Sprintf("%s:", opts.Remote),
+		fmt.Sprintf("%s:%s", opts.Remote, opts.Path),
+	}
+	if opts.Recursive {
+		args = append(args, "--recursive")
+	}
+	if opts.FilesOnly {
+		args = append(args, "--files-only")
+	}
+	if opts.Filter != nil {
+		args = append(args, opts.Filter.Args()...)
 	}
 
-	opts.log.Info("running rclone", "args", args)
-
-	cmd := exec.CommandContext(ctx, "rclone", args...)
-	cmd.Stderr = os.Stderr
-	data, err := cmd.Output()
+	data, err := rcloneCmd{
+		args:    args,
+		remotes: []string{opts.Remote},
+		log:     opts.log,
+	}.output(ctx, config)
 	if err != nil {
-		return nil, fmt.Errorf("rclone lsjson: %w", err)
+		return nil, err
 	}
 
 	var files []FileInfo
@@ -215,15 +403,102 @@ func RcloneListBucketsRemote(ctx context.Context, config BackupConfig, opts List
 		return nil, fmt.Errorf("unmarshal json: %w", err)
 	}
 
-	buckets := make([]string, 0, len(files))
+	opts.log.Info("rclone lsjson complete", "files", len(files))
+	return files, nil
+}
+
+// RcloneListObjects returns the paths of all objects below the specified path of the remote, recursively.
+func RcloneListObjects(ctx context.Context, config BackupConfig, opts ListOptions) ([]string, error) {
+	opts.Recursive = true
+	opts.FilesOnly = true
+	files, err := RcloneList(ctx, config, opts)
+	if err != nil {
+		return nil, err
+	}
+
+	out := make([]string, 0, len(files))
 	for _, f := range files {
-		if f.IsBucket {
-			buckets = append(buckets, f.Name)
-		}
+		out = append(out, f.Path)
 	}
 
-	opts.log.Info("rclone lsjson complete", "buckets", buckets)
-	return buckets, nil
+	return out, nil
+}
+
+type StatOptions struct {
+	Path   string
+	Remote string
+	At     *string
+	log    *slog.Logger
+}
+
+// RcloneStat returns information about a single file or directory of the remote using the rclone command.
+func RcloneStat(ctx context.Context, config BackupConfig, opts StatOptions) (FileInfo, error) {
+	if opts.At != nil {
+		config.Dest.Value.VersionAt.Set(*opts.At)
+	}
+
+	data, err := rcloneCmd{
+		args: []string{
+			"lsjson",
+			"--stat",
+			fmt.Sprintf("%s:%s", opts.Remote, opts.Path),
+		},
+		remotes: []string{opts.Remote},
+		log:     opts.log,
+	}.output(ctx, config)
+	if err != nil {
+		return FileInfo{}, err
+	}
+
+	var file FileInfo
+	err = json.Unmarshal(data, &file)
+	if err != nil {
+		return FileInfo{}, fmt.Errorf("unmarshal json: %w", err)
+	}
+
+	return file, nil
+}
+
+type CopyOptions struct {
+	Path   string
+	Source string
+	Dest   string
+	At     *string
+	// File copies a single file to Dest, instead of the contents of a directory into Dest.
+	File bool
+	// Concurrency is the number of copies running concurrently, which share the bandwidth limits.
+	Concurrency int
+	log         *slog.Logger
+}
+
+// RcloneCopy copies a file or directory from the specified remote to a local path using the rclone command.
+func RcloneCopy(ctx context.Context, config BackupConfig, opts CopyOptions) error {
+	if opts.At != nil {
+		config.Dest.Value.VersionAt.Set(*opts.At)
+	}
+
+	command := "copy"
+	if opts.File {
+		command = "copyto"
+	}
+
+	err := rcloneCmd{
+		args: []string{
+			command,
+			fmt.Sprintf("%s:%s", opts.Source, opts.Path),
+			opts.Dest,
+		},
+		remotes: []string{opts.Source},
+		shares:  opts.Concurrency,
+		stdout:  os.Stderr,
+		log:     opts.log,
+	}.run(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	opts.log.Info("rclone copy complete")
+	return nil
 }
 
 type FileInfo struct {
@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+// RetentionPolicy describes which backup runs are kept as snapshots, in a grandfather-father-son fashion.
+// Each field is the number of most recent periods for which the latest run is kept.
+type RetentionPolicy struct {
+	Last    int `config:"LAST"`
+	Hourly  int `config:"HOURLY"`
+	Daily   int `config:"DAILY"`
+	Weekly  int `config:"WEEKLY"`
+	Monthly int `config:"MONTHLY"`
+	Yearly  int `config:"YEARLY"`
+}
+
+// Enabled reports whether any retention rule is configured.
+func (p RetentionPolicy) Enabled() bool {
+	return p.Last > 0 || p.Hourly > 0 || p.Daily > 0 || p.Weekly > 0 || p.Monthly > 0 || p.Yearly > 0
+}
+
+func (p RetentionPolicy) String() string {
+	if !p.Enabled() {
+		return "none"
+	}
+
+	return fmt.Sprintf("last=%d hourly=%d daily=%d weekly=%d monthly=%d yearly=%d", p.Last, p.Hourly, p.Daily, p.Weekly, p.Monthly, p.Yearly)
+}
+
+type retentionRule struct {
+	name   string
+	count  int
+	period func(t time.Time) string
+}
+
+func (p RetentionPolicy) rules() []retentionRule {
+	return []retentionRule{
+		{"last", p.Last, func(t time.Time) string { return t.Format(time.RFC3339Nano) }},
+		{"hourly", p.Hourly, func(t time.Time) string { return t.Format("2006-01-02T15") }},
+		{"daily", p.Daily, func(t time.Time) string { return t.Format("2006-01-02") }},
+		{"weekly", p.Weekly, func(t time.Time) string {
+			year, week := t.ISOWeek()
+			return fmt.Sprintf("%d-W%02d", year, week)
+		}},
+		{"monthly", p.Monthly, func(t time.Time) string { return t.Format("2006-01") }},
+		{"yearly", p.Yearly, func(t time.Time) string { return t.Format("2006") }},
+	}
+}
+
+// Apply returns the reasons for keeping each run, keyed by run ID. Runs missing from the result are to be forgotten.
+// Periods are evaluated in UTC, the newest run of a period is the one kept.
+func (p RetentionPolicy) Apply(runs []Run) map[string][]string {
+	sorted := slices.Clone(runs)
+	slices.SortFunc(sorted, func(a, b Run) int {
+		return b.FinishedAt.Compare(a.FinishedAt)
+	})
+
+	keep := make(map[string][]string)
+	for _, rule := range p.rules() {
+		remaining := rule.count
+		last := ""
+		for _, run := range sorted {
+			if remaining <= 0 {
+				break
+			}
+
+			period := rule.period(run.FinishedAt.UTC())
+			if period == last {
+				continue
+			}
+
+			last = period
+			remaining--
+			keep[run.ID] = append(keep[run.ID], rule.name)
+		}
+	}
+
+	return keep
+}
+
+// planPrune returns the object versions that are not needed by any of the snapshots.
+//
+// A version is needed by a snapshot if it was the visible version of its key at the snapshot time,
+// i.e. it was written before the snapshot and replaced after it.
+// The latest version of each key is always kept, as are versions replaced after newest,
+// which is the time of the most recent run, so that runs in progress are never affected.
+// A delete marker is only removed once all older versions of its key are removed.
+func planPrune(versions []minio.ObjectInfo, snapshots []time.Time, newest time.Time) []minio.ObjectInfo {
+	byKey := make(map[string][]minio.ObjectInfo)
+	for _, v := range versions {
+		byKey[v.Key] = append(byKey[v.Key], v)
+	}
+
+	keys := make([]string, 0, len(byKey))
+	for key := range byKey {
+		keys = append(keys, key)
+	}
+	slices.Sort(keys)
+
+	var out []minio.ObjectInfo
+	for _, key := range keys {
+		vs := byKey[key]
+		slices.SortStableFunc(vs, func(a, b minio.ObjectInfo) int {
+			return a.LastModified.Compare(b.LastModified)
+		})
+
+		var deletes []minio.ObjectInfo
+		for i, v := range vs[:len(vs)-1] {
+			replaced := vs[i+1].LastModified
+			if !replaced.Before(newest) {
+				continue
+			}
+
+			needed := slices.ContainsFunc(snapshots, func(t time.Time) bool {
+				return !t.Before(v.LastModified) && t.Before(replaced)
+			})
+			if !needed {
+				deletes = append(deletes, v)
+			}
+		}
+
+		latest := vs[len(vs)-1]
+		if latest.IsDeleteMarker && len(deletes) == len(vs)-1 && latest.LastModified.Before(newest) {
+			deletes = append(deletes, latest)
+		}
+
+		out = append(out, deletes...)
+	}
+
+	return out
+}
+
+// planForgetMeta returns the IDs of the metadata archives no kept run references, which are deleted with the forgotten runs.
+// The archive latest points to is always kept, as are archives created after the newest run, which belong to running backups.
+// Runs without a recorded archive reference the newest one created at or before their snapshot, as restores do.
+func planForgetMeta(metas []MetaInfo, kept []Run, latest string, newest time.Time) []string {
+	used := map[string]bool{latest: true}
+	for _, run := range kept {
+		if run.Metadata != "" {
+			used[run.Metadata] = true
+			continue
+		}
+
+		id := ""
+		for _, m := range metas {
+			if m.Created.After(run.Snapshot()) {
+				break
+			}
+
+			id = m.ID
+		}
+		used[id] = true
+	}
+
+	var out []string
+	for _, m := range metas {
+		if !used[m.ID] && m.Created.Before(newest) {
+			out = append(out, m.ID)
+		}
+	}
+
+	return out
+}
+
+// ListObjectVersions returns all versions of all objects in the bucket, including delete markers.
+func (m *Minio) ListObjectVersions(ctx context.Context, bucket string) ([]minio.ObjectInfo, error) {
+	var out []minio.ObjectInfo
+	for obj := range m.client.ListObjects(ctx, bucket, minio.ListObjectsOptions{
+		WithVersions: true,
+		Recursive:    true,
+	}) {
+		if obj.Err != nil {
+			return nil, obj.Err
+		}
+
+		out = append(out, obj)
+	}
+
+	return out, nil
+}
+
+// RemoveObjectVersions permanently removes the specified object versions from the bucket.
+func (m *Minio) RemoveObjectVersions(ctx context.Context, bucket string, versions []minio.ObjectInfo) error {
+	ch := make(chan minio.ObjectInfo)
+	go func() {
+		defer close(ch)
+		for _, v := range versions {
+			select {
+			case ch <- v:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+
+	failed := 0
+	for err := range m.client.RemoveObjects(ctx, bucket, ch, minio.RemoveObjectsOptions{}) {
+		m.log.Error("failed to remove object version", "key", err.ObjectName, "version", err.VersionID, "err", err.Err)
+		failed++
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to remove %d object versions", failed)
+	}
+
+	return ctx.Err()
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/minio/minio-go/v7"
+)
+
+func TestRetentionPolicyApply(t *testing.T) {
+	// one run every 6 hours over 60 days
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	var runs []Run
+	for i := 0; i < 60*4; i++ {
+		run := NewRun(start.Add(time.Duration(i) * 6 * time.Hour))
+		run.FinishedAt = run.StartedAt.Add(time.Hour)
+		runs = append(runs, run)
+	}
+
+	keep := RetentionPolicy{Last: 2, Daily: 7, Weekly: 4, Monthly: 3}.Apply(runs)
+
+	want := map[string][]string{
+		"20240229T180000Z": {"last", "daily", "weekly", "monthly"},
+		"20240229T120000Z": {"last"},
+		"20240228T180000Z": {"daily"},
+		"20240227T180000Z": {"daily"},
+		"20240226T180000Z": {"daily"},
+		"20240225T180000Z": {"daily", "weekly"},
+		"20240224T180000Z": {"daily"},
+		"20240223T180000Z": {"daily"},
+		"20240218T180000Z": {"weekly"},
+		"20240211T180000Z": {"weekly"},
+		"20240131T180000Z": {"monthly"},
+	}
+
+	if len(keep) != len(want) {
+		t.Errorf("expected %d kept runs, got %d: %v", len(want), len(keep), keep)
+	}
+
+	for id, reasons := range want {
+		if !slices.Equal(keep[id], reasons) {
+			t.Errorf("run %s: expected %v, got %v", id, reasons, keep[id])
+		}
+	}
+}
+
+func TestPlanPrune(t *testing.T) {
+	at := func(day int) time.Time {
+		return time.Date(2024, 1, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	version := func(key string, id string, day int) minio.ObjectInfo {
+		return minio.ObjectInfo{Key: key, VersionID: id, LastModified: at(day)}
+	}
+
+	marker := version("deleted", "d3", 3)
+	marker.IsDeleteMarker = true
+
+	versions := []minio.ObjectInfo{
+		// a.txt was written on day 1, 3, 5 and 9
+		version("a.txt", "a1", 1),
+		version("a.txt", "a3", 3),
+		version("a.txt", "a5", 5),
+		version("a.txt", "a9", 9),
+		// deleted was written on day 1 and deleted on day 3
+		version("deleted", "d1", 1),
+		marker,
+		// current is never replaced
+		version("current", "c1", 1),
+	}
+
+	// snapshots taken on day 4 and 8, with the newest run on day 10
+	deletes := planPrune(versions, []time.Time{at(4), at(8)}, at(10))
+
+	var got []string
+	for _, v := range deletes {
+		got = append(got, v.VersionID)
+	}
+
+	want := []string{"a1", "d1", "d3"}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
+
+func TestPlanForgetMeta(t *testing.T) {
+	at := func(day int) time.Time {
+		return time.Date(2024, 1, day, 0, 0, 0, 0, time.UTC)
+	}
+
+	meta := func(day int) MetaInfo {
+		return MetaInfo{ID: at(day).Format(runIDFormat), Created: at(day)}
+	}
+
+	metas := []MetaInfo{meta(1), meta(2), meta(3), meta(4), meta(5), meta(6), meta(8)}
+	kept := []Run{
+		// recorded archive, reused from day 2 as the metadata didn't change
+		{ID: "r4", FinishedAt: at(4).Add(time.Hour), Metadata: meta(2).ID},
+		// no recorded archive, uses the newest one before its snapshot
+		{ID: "r3", FinishedAt: at(3).Add(time.Hour)},
+	}
+
+	// latest points to day 5, the newest run finished on day 7 and a backup started on day 8 is running
+	got := planForgetMeta(metas, kept, meta(5).ID, at(7))
+
+	want := []string{meta(1).ID, meta(4).ID, meta(6).ID}
+	if !slices.Equal(got, want) {
+		t.Errorf("expected %v, got %v", want, got)
+	}
+}
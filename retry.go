@@ -0,0 +1,105 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"math/rand/v2"
+	"os/exec"
+	"slices"
+	"time"
+)
+
+// rcloneRetryableExitCodes are the exit codes of rclone worth retrying, which are temporary and uncategorised errors.
+// Usage errors, missing files, fatal errors such as exceeding --max-delete, and exceeded limits aren't.
+// https://rclone.org/docs/#exit-code
+var rcloneRetryableExitCodes = []int{2, 5}
+
+// RetryPolicy retries backing up or restoring a bucket that failed with a temporary error,
+// such as a 503 from the source, waiting an exponentially growing backoff between attempts.
+type RetryPolicy struct {
+	// Attempts is the number of times a bucket is tried, 1 disables retries.
+	Attempts int `config:"ATTEMPTS"`
+	// Backoff is the delay before the first retry, doubled for each further retry.
+	Backoff string `config:"BACKOFF"`
+	// MaxBackoff caps the delay between retries.
+	MaxBackoff string `config:"MAX_BACKOFF"`
+	// Jitter randomizes each delay by up to this fraction of it, so that concurrent retries spread out.
+	Jitter float64 `config:"JITTER"`
+}
+
+// Validate checks the durations and jitter of the policy.
+func (p RetryPolicy) Validate() error {
+	if _, _, err := p.backoffs(); err != nil {
+		return err
+	}
+
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return fmt.Errorf("retry jitter must be between 0 and 1, got %v", p.Jitter)
+	}
+
+	return nil
+}
+
+func (p RetryPolicy) backoffs() (time.Duration, time.Duration, error) {
+	var backoff, maxBackoff time.Duration
+	var err error
+	if p.Backoff != "" {
+		backoff, err = time.ParseDuration(p.Backoff)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid retry backoff %q: %w", p.Backoff, err)
+		}
+	}
+
+	if p.MaxBackoff != "" {
+		maxBackoff, err = time.ParseDuration(p.MaxBackoff)
+		if err != nil {
+			return 0, 0, fmt.Errorf("invalid retry max backoff %q: %w", p.MaxBackoff, err)
+		}
+	}
+
+	return backoff, maxBackoff, nil
+}
+
+// Delay returns the delay before the retry following the failed attempt, which starts at 1.
+// r is a random number in [0, 1) applying the jitter.
+func (p RetryPolicy) Delay(attempt int, r float64) time.Duration {
+	backoff, maxBackoff, _ := p.backoffs()
+	delay := backoff
+	for i := 1; i < attempt && (maxBackoff == 0 || delay < maxBackoff); i++ {
+		delay *= 2
+	}
+
+	if maxBackoff > 0 {
+		delay = min(delay, maxBackoff)
+	}
+
+	return time.Duration(float64(delay) * (1 + p.Jitter*(2*r-1)))
+}
+
+// retryable reports whether the error of a failed rclone command is worth retrying.
+func retryable(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && slices.Contains(rcloneRetryableExitCodes, exitErr.ExitCode())
+}
+
+// Do calls fn until it succeeds, fails with an error not worth retrying, or the attempts are exhausted.
+// It returns the number of attempts made and the error of the last one.
+func (p RetryPolicy) Do(ctx context.Context, log *slog.Logger, fn func() error) (int, error) {
+	attempts := max(p.Attempts, 1)
+	for attempt := 1; ; attempt++ {
+		err := fn()
+		if err == nil || attempt >= attempts || !retryable(err) {
+			return attempt, err
+		}
+
+		delay := p.Delay(attempt, rand.Float64())
+		log.Warn("attempt failed, retrying", "attempt", attempt, "attempts", attempts, "delay", delay, "err", err)
+		select {
+		case <-ctx.Done():
+			return attempt, err
+		case <-time.After(delay):
+		}
+	}
+}
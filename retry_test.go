@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"os/exec"
+	"testing"
+	"time"
+)
+
+func TestRetryPolicy(t *testing.T) {
+	p := RetryPolicy{Attempts: 3, Backoff: "1s", MaxBackoff: "5s", Jitter: 0.5}
+	if err := p.Validate(); err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt, want := range map[int]time.Duration{1: time.Second, 2: 2 * time.Second, 3: 4 * time.Second, 4: 5 * time.Second, 10: 5 * time.Second} {
+		if got := p.Delay(attempt, 0.5); got != want {
+			t.Errorf("attempt %d: expected delay %s, got %s", attempt, want, got)
+		}
+	}
+
+	if got := p.Delay(1, 0); got != 500*time.Millisecond {
+		t.Errorf("expected jitter to halve the delay, got %s", got)
+	}
+
+	if err := (RetryPolicy{Backoff: "soon"}).Validate(); err == nil {
+		t.Error("expected error for invalid backoff")
+	}
+
+	exit := func(code string) error {
+		return exec.Command("sh", "-c", "exit "+code).Run()
+	}
+
+	p = RetryPolicy{Attempts: 3}
+	calls := 0
+	attempts, err := p.Do(context.Background(), slog.Default(), func() error {
+		calls++
+		if calls < 2 {
+			return exit("5")
+		}
+		return nil
+	})
+	if err != nil || attempts != 2 {
+		t.Errorf("expected success after 2 attempts, got %d: %v", attempts, err)
+	}
+
+	attempts, err = p.Do(context.Background(), slog.Default(), func() error { return exit("2") })
+	if err == nil || attempts != 3 {
+		t.Errorf("expected failure after 3 attempts, got %d: %v", attempts, err)
+	}
+
+	attempts, err = p.Do(context.Background(), slog.Default(), func() error { return exit("7") })
+	if err == nil || attempts != 1 {
+		t.Errorf("expected fatal error not to be retried, got %d attempts: %v", attempts, err)
+	}
+
+	attempts, _ = p.Do(context.Background(), slog.Default(), func() error { return errors.New("not rclone") })
+	if attempts != 1 {
+		t.Errorf("expected other errors not to be retried, got %d attempts", attempts)
+	}
+}
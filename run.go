@@ -0,0 +1,241 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"time"
+)
+
+const (
+	// stateDir is the directory in the crypt remote holding the state of s32s3 itself, such as run records.
+	// Bucket names can't start with a dot, so it never collides with a backed up bucket.
+	stateDir = ".s32s3"
+
+	// runsDir is the directory in the crypt remote holding one record per backup run.
+	runsDir = stateDir + "/runs"
+
+	// runIDFormat is the time format of run IDs, derived from the start time of the run.
+	runIDFormat = "20060102T150405Z"
+)
+
+// Run is the record of a backup run. Each run is a snapshot that can be restored by its finish time.
+// Metadata is the ID of the metadata archive of the run. Skipped lists the buckets left out by filters.
+type Run struct {
+	ID         string      `json:"id"`
+	StartedAt  time.Time   `json:"startedAt"`
+	FinishedAt time.Time   `json:"finishedAt"`
+	Metadata   string      `json:"metadata,omitempty"`
+	Buckets    []BucketRun `json:"buckets"`
+	Skipped    []string    `json:"skipped,omitempty"`
+}
+
+// BucketRun is the outcome of backing up a single bucket during a run.
+// PointInTime is set if the bucket was backed up as of the start of the run, which requires versioning on the source.
+// Filter is the object filter the bucket was backed up with, if only some of its objects were backed up.
+// Tombstones and Deleted count the objects kept after their deletion on the source, and the ones deleted from the backup
+// after their grace period, if the bucket was backed up in copy mode.
+// MassDeletion is set if the bucket wasn't backed up because too many objects would have been deleted from the backup.
+// Attempts is the number of times syncing the bucket was tried, more than one if it was retried.
+// Duration is the time spent on the bucket, including retries.
+type BucketRun struct {
+	Name         string        `json:"name"`
+	PointInTime  bool          `json:"pointInTime"`
+	Attempts     int           `json:"attempts,omitempty"`
+	Filter       *ObjectFilter `json:"filter,omitempty"`
+	Tombstones   int           `json:"tombstones,omitempty"`
+	Deleted      int           `json:"deleted,omitempty"`
+	MassDeletion bool          `json:"massDeletion,omitempty"`
+	Duration     string        `json:"duration,omitempty"`
+	Error        string        `json:"error,omitempty"`
+}
+
+// NewRun starts a new run at the specified time.
+func NewRun(start time.Time) Run {
+	start = start.UTC().Truncate(time.Second)
+	return Run{
+		ID:        start.Format(runIDFormat),
+		StartedAt: start,
+	}
+}
+
+// Snapshot returns the time to restore the run at. All data synced during the run is visible in the backup at that time.
+// It's rounded up to the second, as that is the precision the time is passed to rclone with.
+func (r Run) Snapshot() time.Time {
+	return r.FinishedAt.Truncate(time.Second).Add(time.Second)
+}
+
+// MassDeletions returns the names of the buckets not backed up because too many objects would have been deleted.
+func (r Run) MassDeletions() []string {
+	var out []string
+	for _, b := range r.Buckets {
+		if b.MassDeletion {
+			out = append(out, b.Name)
+		}
+	}
+
+	return out
+}
+
+// Failed returns the names of the buckets that failed to back up.
+func (r Run) Failed() []string {
+	return failedBuckets(r.Buckets)
+}
+
+func failedBuckets(buckets []BucketRun) []string {
+	var out []string
+	for _, b := range buckets {
+		if b.Error != "" {
+			out = append(out, b.Name)
+		}
+	}
+
+	return out
+}
+
+type WriteRunOptions struct {
+	Run Run
+	log *slog.Logger
+}
+
+// RcloneWriteRun stores the run record in the crypt remote.
+func RcloneWriteRun(ctx context.Context, config BackupConfig, opts WriteRunOptions) error {
+	dir, err := os.MkdirTemp("", "s32s3-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	data, err := json.Marshal(opts.Run)
+	if err != nil {
+		return fmt.Errorf("marshal run: %w", err)
+	}
+
+	file := filepath.Join(dir, opts.Run.ID+".json")
+	err = os.WriteFile(file, append(data, '\n'), 0o644)
+	if err != nil {
+		return err
+	}
+
+	return RcloneSyncFile(ctx, config, SyncFileOptions{
+		File: file,
+		Dest: config.Crypt.Name,
+		Dir:  runsDir,
+		log:  opts.log,
+	})
+}
+
+type ListRunsOptions struct {
+	At  *string
+	log *slog.Logger
+}
+
+// RcloneListRuns returns the records of all runs stored in the crypt remote, oldest first.
+func RcloneListRuns(ctx context.Context, config BackupConfig, opts ListRunsOptions) ([]Run, error) {
+	buf := bytes.NewBuffer(nil)
+	err := RcloneCat(ctx, config, CatOptions{
+		Path:   runsDir,
+		Source: config.Crypt.Name,
+		At:     opts.At,
+		Out:    buf,
+		log:    opts.log,
+	})
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && exitErr.ExitCode() == rcloneExitDirNotFound {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	var runs []Run
+	dec := json.NewDecoder(buf)
+	for {
+		var run Run
+		err := dec.Decode(&run)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, fmt.Errorf("decode run: %w", err)
+		}
+
+		runs = append(runs, run)
+	}
+
+	slices.SortFunc(runs, func(a, b Run) int {
+		return a.StartedAt.Compare(b.StartedAt)
+	})
+
+	return runs, nil
+}
+
+type ForgetRunsOptions struct {
+	IDs []string
+	log *slog.Logger
+}
+
+// RcloneForgetRuns deletes the records of the specified runs from the crypt remote.
+func RcloneForgetRuns(ctx context.Context, config BackupConfig, opts ForgetRunsOptions) error {
+	for _, id := range opts.IDs {
+		err := RcloneDeleteFile(ctx, config, DeleteFileOptions{
+			File:   path.Join(runsDir, id+".json"),
+			Remote: config.Crypt.Name,
+			log:    opts.log.With("run", id),
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// errRunNotFound is returned for a run ID without a record.
+var errRunNotFound = errors.New("run not found")
+
+// findRun returns the record of the run with the specified ID.
+func findRun(ctx context.Context, config BackupConfig, id string, log *slog.Logger) (Run, error) {
+	runs, err := RcloneListRuns(ctx, config, ListRunsOptions{log: log})
+	if err != nil {
+		return Run{}, err
+	}
+
+	for _, run := range runs {
+		if run.ID == id {
+			return run, nil
+		}
+	}
+
+	return Run{}, fmt.Errorf("%w: %q", errRunNotFound, id)
+}
+
+// resolveAt returns the time to read the backup at, given either a time or the ID of a run to restore.
+// If a run ID is given, its record is returned as well.
+func resolveAt(ctx context.Context, config BackupConfig, at *string, runID string, log *slog.Logger) (*string, *Run, error) {
+	if runID == "" {
+		return at, nil, nil
+	}
+
+	if at != nil {
+		return nil, nil, fmt.Errorf("--at and --run are mutually exclusive")
+	}
+
+	run, err := findRun(ctx, config, runID, log)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	snapshot := run.Snapshot().Format(time.RFC3339)
+	log.Info("using snapshot of run", "run", run.ID, "at", snapshot)
+	return &snapshot, &run, nil
+}
@@ -0,0 +1,439 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"path"
+	"slices"
+	"strings"
+
+	"github.com/minio/minio-go/v7"
+	"github.com/minio/minio-go/v7/pkg/cors"
+	"github.com/minio/minio-go/v7/pkg/lifecycle"
+	"github.com/minio/minio-go/v7/pkg/notification"
+	"github.com/minio/minio-go/v7/pkg/replication"
+	"github.com/minio/minio-go/v7/pkg/sse"
+	"github.com/minio/minio-go/v7/pkg/tags"
+)
+
+// bucketConfigNotFoundCodes are the S3 error codes returned for bucket settings which aren't configured.
+var bucketConfigNotFoundCodes = []string{
+	"NoSuchBucketPolicy",
+	"NoSuchLifecycleConfiguration",
+	"NoSuchCORSConfiguration",
+	"NoSuchTagSet",
+	"ServerSideEncryptionConfigurationNotFoundError",
+	"ObjectLockConfigurationNotFoundError",
+	"ReplicationConfigurationNotFoundError",
+}
+
+// bucketSetting is a part of the bucket configuration, stored as one readable JSON or XML file per bucket.
+type bucketSetting struct {
+	file string
+	// get returns the setting, or nil if it isn't configured.
+	get func(ctx context.Context, c *minio.Client, bucket string) ([]byte, error)
+	set func(ctx context.Context, c *minio.Client, bucket string, data []byte) error
+}
+
+// objectLockConfig is the object lock configuration of a bucket, with its optional default retention.
+type objectLockConfig struct {
+	Enabled  bool   `json:"enabled"`
+	Mode     string `json:"mode,omitempty"`
+	Validity uint   `json:"validity,omitempty"`
+	Unit     string `json:"unit,omitempty"`
+}
+
+const (
+	bucketPolicyFile     = "policy.json"
+	bucketVersioningFile = "versioning.xml"
+	bucketObjectLockFile = "object-lock.json"
+	// bucketExportErrorFile holds the error of a bucket which failed to export, instead of its settings.
+	bucketExportErrorFile = "export-error.txt"
+)
+
+// bucketSettings are the exported bucket settings, in the order they are restored.
+// Versioning and object lock come first, as other settings may depend on them.
+var bucketSettings = []bucketSetting{
+	{
+		file: bucketVersioningFile,
+		get: func(ctx context.Context, c *minio.Client, bucket string) ([]byte, error) {
+			v, err := c.GetBucketVersioning(ctx, bucket)
+			if err != nil || v.Status == "" {
+				return nil, err
+			}
+
+			return xml.MarshalIndent(v, "", "  ")
+		},
+		set: func(ctx context.Context, c *minio.Client, bucket string, data []byte) error {
+			v := minio.BucketVersioningConfiguration{}
+			if err := xml.Unmarshal(data, &v); err != nil {
+				return err
+			}
+
+			return c.SetBucketVersioning(ctx, bucket, v)
+		},
+	},
+	{
+		file: bucketObjectLockFile,
+		get: func(ctx context.Context, c *minio.Client, bucket string) ([]byte, error) {
+			enabled, mode, validity, unit, err := c.GetObjectLockConfig(ctx, bucket)
+			if err != nil || enabled != "Enabled" {
+				return nil, err
+			}
+
+			v := objectLockConfig{Enabled: true}
+			if mode != nil && validity != nil && unit != nil {
+				v.Mode, v.Validity, v.Unit = mode.String(), *validity, unit.String()
+			}
+
+			return json.MarshalIndent(v, "", "  ")
+		},
+		set: func(ctx context.Context, c *minio.Client, bucket string, data []byte) error {
+			v := objectLockConfig{}
+			if err := json.Unmarshal(data, &v); err != nil {
+				return err
+			}
+
+			// object lock itself is enabled when the bucket is created, only the default retention is set here
+			if v.Mode == "" {
+				return nil
+			}
+
+			mode := minio.RetentionMode(v.Mode)
+			unit := minio.ValidityUnit(v.Unit)
+			return c.SetObjectLockConfig(ctx, bucket, &mode, &v.Validity, &unit)
+		},
+	},
+	{
+		file: bucketPolicyFile,
+		get: func(ctx context.Context, c *minio.Client, bucket string) ([]byte, error) {
+			policy, err := c.GetBucketPolicy(ctx, bucket)
+			if err != nil || policy == "" {
+				return nil, err
+			}
+
+			buf := bytes.NewBuffer(nil)
+			if err := json.Indent(buf, []byte(policy), "", "  "); err != nil {
+				return []byte(policy), nil
+			}
+
+			return buf.Bytes(), nil
+		},
+		set: func(ctx context.Context, c *minio.Client, bucket string, data []byte) error {
+			return c.SetBucketPolicy(ctx, bucket, string(data))
+		},
+	},
+	{
+		file: "lifecycle.xml",
+		get: func(ctx context.Context, c *minio.Client, bucket string) ([]byte, error) {
+			v, err := c.GetBucketLifecycle(ctx, bucket)
+			if err != nil || v.Empty() {
+				return nil, err
+			}
+
+			return xml.MarshalIndent(v, "", "  ")
+		},
+		set: func(ctx context.Context, c *minio.Client, bucket string, data []byte) error {
+			v := lifecycle.NewConfiguration()
+			if err := xml.Unmarshal(data, v); err != nil {
+				return err
+			}
+
+			return c.SetBucketLifecycle(ctx, bucket, v)
+		},
+	},
+	{
+		file: "cors.xml",
+		get: func(ctx context.Context, c *minio.Client, bucket string) ([]byte, error) {
+			v, err := c.GetBucketCors(ctx, bucket)
+			if err != nil || v == nil || len(v.CORSRules) == 0 {
+				return nil, err
+			}
+
+			return xml.MarshalIndent(v, "", "  ")
+		},
+		set: func(ctx context.Context, c *minio.Client, bucket string, data []byte) error {
+			v, err := cors.ParseBucketCorsConfig(bytes.NewReader(data))
+			if err != nil {
+				return err
+			}
+
+			return c.SetBucketCors(ctx, bucket, v)
+		},
+	},
+	{
+		file: "tagging.json",
+		get: func(ctx context.Context, c *minio.Client, bucket string) ([]byte, error) {
+			v, err := c.GetBucketTagging(ctx, bucket)
+			if err != nil || v.Count() == 0 {
+				return nil, err
+			}
+
+			return json.MarshalIndent(v.ToMap(), "", "  ")
+		},
+		set: func(ctx context.Context, c *minio.Client, bucket string, data []byte) error {
+			m := map[string]string{}
+			if err := json.Unmarshal(data, &m); err != nil {
+				return err
+			}
+
+			v, err := tags.MapToBucketTags(m)
+			if err != nil {
+				return err
+			}
+
+			return c.SetBucketTagging(ctx, bucket, v)
+		},
+	},
+	{
+		file: "encryption.xml",
+		get: func(ctx context.Context, c *minio.Client, bucket string) ([]byte, error) {
+			v, err := c.GetBucketEncryption(ctx, bucket)
+			if err != nil || v == nil || len(v.Rules) == 0 {
+				return nil, err
+			}
+
+			return xml.MarshalIndent(v, "", "  ")
+		},
+		set: func(ctx context.Context, c *minio.Client, bucket string, data []byte) error {
+			v := &sse.Configuration{}
+			if err := xml.Unmarshal(data, v); err != nil {
+				return err
+			}
+
+			return c.SetBucketEncryption(ctx, bucket, v)
+		},
+	},
+	{
+		file: "replication.xml",
+		get: func(ctx context.Context, c *minio.Client, bucket string) ([]byte, error) {
+			v, err := c.GetBucketReplication(ctx, bucket)
+			if err != nil || v.Empty() {
+				return nil, err
+			}
+
+			return xml.MarshalIndent(v, "", "  ")
+		},
+		set: func(ctx context.Context, c *minio.Client, bucket string, data []byte) error {
+			v := replication.Config{}
+			if err := xml.Unmarshal(data, &v); err != nil {
+				return err
+			}
+
+			return c.SetBucketReplication(ctx, bucket, v)
+		},
+	},
+	{
+		file: "notification.xml",
+		get: func(ctx context.Context, c *minio.Client, bucket string) ([]byte, error) {
+			v, err := c.GetBucketNotification(ctx, bucket)
+			if err != nil || len(v.LambdaConfigs)+len(v.TopicConfigs)+len(v.QueueConfigs) == 0 {
+				return nil, err
+			}
+
+			return xml.MarshalIndent(v, "", "  ")
+		},
+		set: func(ctx context.Context, c *minio.Client, bucket string, data []byte) error {
+			v := notification.Configuration{}
+			if err := xml.Unmarshal(data, &v); err != nil {
+				return err
+			}
+
+			return c.SetBucketNotification(ctx, bucket, v)
+		},
+	},
+}
+
+// S3Exporter exports and restores the bucket configuration exposed by the plain S3 API,
+// for providers without an admin API. IAM and server configuration are not exported.
+type S3Exporter struct {
+	m *Minio
+}
+
+// Source returns the provider of the instance.
+func (e S3Exporter) Source(ctx context.Context) (ManifestSource, error) {
+	return ManifestSource{Provider: e.m.config.Provider}, nil
+}
+
+// Export spools the configuration of all buckets into dir, see exportBucketConfig.
+func (e S3Exporter) Export(ctx context.Context, dir string) ([]metaEntry, error) {
+	entry, err := exportBucketConfig(ctx, e.m, dir)
+	if err != nil {
+		return nil, err
+	}
+
+	return []metaEntry{entry}, nil
+}
+
+// exportBucketConfig spools the configuration of all buckets into dir through the S3 API,
+// as a zip archive with one readable JSON or XML file per bucket and setting.
+// A bucket failing to export is logged and skipped, with the error recorded in its bucketExportErrorFile.
+func exportBucketConfig(ctx context.Context, m *Minio, dir string) (metaEntry, error) {
+	buckets, err := m.ListBuckets(ctx)
+	if err != nil {
+		return metaEntry{}, fmt.Errorf("list buckets: %w", err)
+	}
+
+	return spoolWriter(dir, fileBucketConfig, func(w io.Writer) error {
+		archive := zip.NewWriter(w)
+		for _, bucket := range buckets {
+			files, err := exportBucketSettings(ctx, m, bucket)
+			if err != nil {
+				m.log.Error("failed to export bucket config, skipping bucket", "bucket", bucket, "err", err)
+				files = map[string][]byte{bucketExportErrorFile: []byte(err.Error() + "\n")}
+			}
+
+			for _, file := range mapKeys(files) {
+				f, err := archive.Create(path.Join(bucket, file))
+				if err != nil {
+					return err
+				}
+
+				if _, err := f.Write(files[file]); err != nil {
+					return err
+				}
+			}
+		}
+
+		return archive.Close()
+	})
+}
+
+// exportBucketSettings returns the configured settings of the bucket, keyed by file name.
+func exportBucketSettings(ctx context.Context, m *Minio, bucket string) (map[string][]byte, error) {
+	out := map[string][]byte{}
+	for _, s := range bucketSettings {
+		data, err := s.get(ctx, m.client, bucket)
+		code := minio.ToErrorResponse(err).Code
+		if code == "NotImplemented" {
+			m.log.Warn("bucket setting not supported by provider", "bucket", bucket, "file", s.file)
+			continue
+		}
+		if slices.Contains(bucketConfigNotFoundCodes, code) || (err == nil && data == nil) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("export %s of bucket %s: %w", s.file, bucket, err)
+		}
+
+		out[s.file] = data
+	}
+
+	return out, nil
+}
+
+// Restore restores the bucket configuration, see restoreBucketConfig.
+func (e S3Exporter) Restore(ctx context.Context, archive MetaArchive, opts RestoreMetaOptions) error {
+	if opts.IAM && archive.Has(fileIAM) {
+		e.m.log.Warn("iam can't be restored through the s3 api, skipping")
+	}
+
+	if opts.Config && archive.Has(fileConfig) {
+		e.m.log.Warn("server config can't be restored through the s3 api, skipping")
+	}
+
+	if !opts.Buckets || !archive.Has(fileBucketConfig) {
+		return nil
+	}
+
+	return restoreBucketConfig(ctx, e.m, archive, opts.OnlyBuckets)
+}
+
+// restoreBucketConfig creates the buckets of the archive, with object lock if it was enabled, and restores their configuration.
+// Only the buckets in only are restored, unless it's empty.
+// Settings failing to restore, such as replication rules referring to targets which don't exist, are logged and skipped.
+func restoreBucketConfig(ctx context.Context, m *Minio, archive MetaArchive, only []string) error {
+	e := S3Exporter{m: m}
+	f, err := archive.Open(fileBucketConfig)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	r, err := zip.NewReader(f, info.Size())
+	if err != nil {
+		return fmt.Errorf("open %s: %w", fileBucketConfig, err)
+	}
+
+	files := map[string]map[string][]byte{}
+	for _, zf := range r.File {
+		bucket, file, ok := strings.Cut(zf.Name, "/")
+		if !ok || (len(only) > 0 && !slices.Contains(only, bucket)) {
+			continue
+		}
+
+		data, err := readZipFile(zf)
+		if err != nil {
+			return err
+		}
+
+		if files[bucket] == nil {
+			files[bucket] = map[string][]byte{}
+		}
+		files[bucket][file] = data
+	}
+
+	failed := 0
+	for _, bucket := range mapKeys(files) {
+		log := m.log.With("bucket", bucket)
+		err := e.createBucket(ctx, bucket, files[bucket][bucketObjectLockFile])
+		if err != nil {
+			return fmt.Errorf("create bucket %s: %w", bucket, err)
+		}
+
+		if msg, ok := files[bucket][bucketExportErrorFile]; ok {
+			log.Warn("bucket config failed to export, not restoring it", "err", strings.TrimSpace(string(msg)))
+		}
+
+		for _, s := range bucketSettings {
+			data, ok := files[bucket][s.file]
+			if !ok {
+				continue
+			}
+
+			log.Info("restoring bucket setting", "file", s.file)
+			err := s.set(ctx, m.client, bucket, data)
+			if err != nil {
+				log.Error("failed to restore bucket setting", "file", s.file, "err", err)
+				failed++
+			}
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d bucket settings failed to restore", failed)
+	}
+
+	return nil
+}
+
+// createBucket creates the bucket if it doesn't exist, enabling object lock if the archived configuration has it.
+func (e S3Exporter) createBucket(ctx context.Context, bucket string, objectLock []byte) error {
+	exists, err := e.m.client.BucketExists(ctx, bucket)
+	if err != nil || exists {
+		return err
+	}
+
+	lock := objectLockConfig{}
+	if objectLock != nil {
+		if err := json.Unmarshal(objectLock, &lock); err != nil {
+			return err
+		}
+	}
+
+	e.m.log.Info("creating bucket", "bucket", bucket, "objectLock", lock.Enabled)
+	return e.m.client.MakeBucket(ctx, bucket, minio.MakeBucketOptions{
+		Region:        e.m.config.Region,
+		ObjectLocking: lock.Enabled,
+	})
+}
@@ -0,0 +1,89 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/rclone/rclone/backend/s3"
+)
+
+func TestExportBucketConfigSkipsFailedBucket(t *testing.T) {
+	notFound := map[string]string{
+		"object-lock":  "ObjectLockConfigurationNotFoundError",
+		"policy":       "NoSuchBucketPolicy",
+		"lifecycle":    "NoSuchLifecycleConfiguration",
+		"cors":         "NoSuchCORSConfiguration",
+		"tagging":      "NoSuchTagSet",
+		"encryption":   "ServerSideEncryptionConfigurationNotFoundError",
+		"replication":  "ReplicationConfigurationNotFoundError",
+		"notification": "NotImplemented",
+	}
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		bucket := strings.Trim(r.URL.Path, "/")
+		switch {
+		case bucket == "":
+			fmt.Fprint(w, `<ListAllMyBucketsResult><Buckets><Bucket><Name>denied</Name></Bucket><Bucket><Name>logs</Name></Bucket></Buckets></ListAllMyBucketsResult>`)
+		case bucket == "denied":
+			w.WriteHeader(http.StatusForbidden)
+			fmt.Fprint(w, `<Error><Code>AccessDenied</Code><Message>Access Denied.</Message></Error>`)
+		case r.URL.Query().Has("versioning"):
+			fmt.Fprint(w, `<VersioningConfiguration><Status>Enabled</Status></VersioningConfiguration>`)
+		default:
+			for query, code := range notFound {
+				if r.URL.Query().Has(query) {
+					w.WriteHeader(http.StatusNotFound)
+					fmt.Fprintf(w, `<Error><Code>%s</Code></Error>`, code)
+					return
+				}
+			}
+			t.Errorf("unexpected request %s", r.URL)
+			w.WriteHeader(http.StatusBadRequest)
+		}
+	}))
+	defer server.Close()
+
+	m, err := NewMinio(slog.New(slog.NewTextHandler(io.Discard, nil)), s3.Options{
+		Endpoint:        server.URL,
+		Region:          "us-east-1",
+		AccessKeyID:     "access",
+		SecretAccessKey: "secret",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	entry, err := exportBucketConfig(context.Background(), m, t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(entry.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if int64(len(data)) != entry.size {
+		t.Errorf("expected size %d, got %d", len(data), entry.size)
+	}
+
+	files, err := readZip(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(files) != 2 || !strings.Contains(string(files["logs/versioning.xml"]), "Enabled") {
+		t.Errorf("unexpected files: %v", mapKeys(files))
+	}
+
+	if !strings.Contains(string(files["denied/"+bucketExportErrorFile]), "Access Denied") {
+		t.Errorf("expected error of denied bucket to be recorded, got %q", files["denied/"+bucketExportErrorFile])
+	}
+}
@@ -0,0 +1,371 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	operationBackup  = "backup"
+	operationRestore = "restore"
+
+	// defaultRunsLimit is the number of runs listed by the API, unless requested otherwise.
+	defaultRunsLimit = 10
+)
+
+// ServeConfig configures the HTTP API of the serve command.
+type ServeConfig struct {
+	// Token authenticates requests as a bearer token.
+	Token string `config:"TOKEN"`
+}
+
+// Operation is a backup or restore started through the HTTP API.
+type Operation struct {
+	Kind       string     `json:"kind"`
+	StartedAt  time.Time  `json:"startedAt"`
+	FinishedAt *time.Time `json:"finishedAt,omitempty"`
+	// Progress is the progress of the buckets of the operation.
+	Progress ProgressSnapshot `json:"progress"`
+	// Run is the record of a backup, once finished.
+	Run *Run `json:"run,omitempty"`
+	// Restore is the summary of a restore, once finished.
+	Restore *RestoreSummary `json:"restore,omitempty"`
+	// Error is set if the operation failed as a whole.
+	Error string `json:"error,omitempty"`
+
+	progress *Progress
+	cancel   context.CancelFunc
+}
+
+// Status is the state of the server, returned by the status endpoint.
+type Status struct {
+	// Current is the running operation, if any.
+	Current *Operation `json:"current,omitempty"`
+	// Last is the last finished operation, if any.
+	Last *Operation `json:"last,omitempty"`
+}
+
+// RestoreRequest is the body of a restore request, see RestoreOptions.
+type RestoreRequest struct {
+	At       string   `json:"at,omitempty"`
+	Run      string   `json:"run,omitempty"`
+	MetaFrom string   `json:"metaFrom,omitempty"`
+	Meta     *string  `json:"meta,omitempty"`
+	Buckets  []string `json:"buckets,omitempty"`
+}
+
+// Options returns the options of the restore. Metadata is restored as by the restore command unless Meta is set,
+// with an empty string restoring none.
+func (r RestoreRequest) Options() (RestoreOptions, error) {
+	meta := "iam,buckets,config"
+	if r.Meta != nil {
+		meta = *r.Meta
+	}
+
+	opts := RestoreOptions{
+		Run:      r.Run,
+		MetaFrom: r.MetaFrom,
+		Buckets:  r.Buckets,
+	}
+	if r.At != "" {
+		opts.At = &r.At
+	}
+
+	if meta != "" {
+		var err error
+		opts.Meta, err = ParseRestoreMetaOptions(meta)
+		if err != nil {
+			return RestoreOptions{}, err
+		}
+	}
+
+	return opts, nil
+}
+
+// Server serves the status of backups and restores over HTTP, and starts and cancels them.
+// It runs one operation at a time, through the same code paths as the backup and restore commands.
+type Server struct {
+	config BackupConfig
+	log    *slog.Logger
+	// ctx is the context operations run in, they're canceled with it.
+	ctx context.Context
+
+	mu      sync.Mutex
+	current *Operation
+	last    *Operation
+	// done is closed once the current operation finished.
+	done chan struct{}
+}
+
+// NewServer returns a server running operations with the configuration until the context is done.
+func NewServer(ctx context.Context, config BackupConfig, log *slog.Logger) *Server {
+	return &Server{config: config, log: log, ctx: ctx}
+}
+
+// Handler returns the HTTP handler of the API. All endpoints but /healthz require the token of the configuration.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /healthz", func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNoContent)
+	})
+	mux.Handle("GET /status", s.auth(s.handleStatus))
+	mux.Handle("GET /runs", s.auth(s.handleRuns))
+	mux.Handle("GET /runs/{id}", s.auth(s.handleRun))
+	mux.Handle("POST /backup", s.auth(s.handleBackup))
+	mux.Handle("POST /restore", s.auth(s.handleRestore))
+	mux.Handle("POST /cancel", s.auth(s.handleCancel))
+	return mux
+}
+
+func (s *Server) auth(next http.HandlerFunc) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(token), []byte(s.config.Serve.Token)) != 1 {
+			writeError(w, http.StatusUnauthorized, errors.New("invalid token"))
+			return
+		}
+
+		next(w, r)
+	})
+}
+
+func writeJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+func writeError(w http.ResponseWriter, status int, err error) {
+	writeJSON(w, status, map[string]string{"error": err.Error()})
+}
+
+// Status returns the current and last operation.
+func (s *Server) Status() Status {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	snapshot := func(op *Operation) *Operation {
+		if op == nil {
+			return nil
+		}
+
+		out := *op
+		out.Progress = op.progress.Snapshot()
+		return &out
+	}
+
+	return Status{Current: snapshot(s.current), Last: snapshot(s.last)}
+}
+
+func (s *Server) handleStatus(w http.ResponseWriter, r *http.Request) {
+	writeJSON(w, http.StatusOK, s.Status())
+}
+
+func (s *Server) handleRuns(w http.ResponseWriter, r *http.Request) {
+	limit := defaultRunsLimit
+	if v := r.URL.Query().Get("limit"); v != "" {
+		var err error
+		limit, err = strconv.Atoi(v)
+		if err != nil || limit < 1 {
+			writeError(w, http.StatusBadRequest, fmt.Errorf("invalid limit %q", v))
+			return
+		}
+	}
+
+	runs, err := RcloneListRuns(r.Context(), s.config, ListRunsOptions{log: s.log})
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	// newest first
+	slices.Reverse(runs)
+	writeJSON(w, http.StatusOK, runs[:min(limit, len(runs))])
+}
+
+func (s *Server) handleRun(w http.ResponseWriter, r *http.Request) {
+	run, err := findRun(r.Context(), s.config, r.PathValue("id"), s.log)
+	if errors.Is(err, errRunNotFound) {
+		writeError(w, http.StatusNotFound, err)
+		return
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	writeJSON(w, http.StatusOK, run)
+}
+
+func (s *Server) handleBackup(w http.ResponseWriter, r *http.Request) {
+	op, err := s.Start(operationBackup, func(ctx context.Context, op *Operation) error {
+		run, err := Backup(ctx, s.config, BackupOptions{
+			Progress: op.progress,
+			log:      s.log.With("operation", operationBackup),
+		})
+		if run.ID != "" {
+			op.Run = &run
+		}
+		return err
+	})
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, op)
+}
+
+func (s *Server) handleRestore(w http.ResponseWriter, r *http.Request) {
+	var req RestoreRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Errorf("decode request: %w", err))
+		return
+	}
+
+	opts, err := req.Options()
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	op, err := s.Start(operationRestore, func(ctx context.Context, op *Operation) error {
+		opts.Progress = op.progress
+		opts.log = s.log.With("operation", operationRestore)
+		summary, err := Restore(ctx, s.config, opts)
+		op.Restore = &summary
+		return err
+	})
+	if err != nil {
+		writeError(w, http.StatusConflict, err)
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, op)
+}
+
+func (s *Server) handleCancel(w http.ResponseWriter, r *http.Request) {
+	if !s.Cancel() {
+		writeError(w, http.StatusConflict, errors.New("no operation running"))
+		return
+	}
+
+	writeJSON(w, http.StatusAccepted, s.Status())
+}
+
+// Start runs an operation in the background, unless another one is running.
+// The result of fn is recorded in the operation, which is accessed under the lock of the server once fn returned.
+func (s *Server) Start(kind string, fn func(ctx context.Context, op *Operation) error) (Operation, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current != nil {
+		return Operation{}, fmt.Errorf("%s already running since %s", s.current.Kind, s.current.StartedAt.Format(time.RFC3339))
+	}
+
+	ctx, cancel := context.WithCancel(s.ctx)
+	op := &Operation{
+		Kind:      kind,
+		StartedAt: time.Now().UTC(),
+		progress:  NewProgress(),
+		cancel:    cancel,
+	}
+	s.current = op
+	s.done = make(chan struct{})
+	s.log.Info("starting operation", "operation", kind)
+
+	go func() {
+		defer cancel()
+
+		// fn records its result in a copy, so that the status can be read while it runs
+		result := *op
+		err := fn(ctx, &result)
+
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		finished := time.Now().UTC()
+		result.FinishedAt = &finished
+		if err != nil {
+			s.log.Error("operation failed", "operation", kind, "err", err)
+			result.Error = err.Error()
+		}
+
+		s.last = &result
+		s.current = nil
+		close(s.done)
+	}()
+
+	return *op, nil
+}
+
+// Cancel cancels the running operation, and reports whether there was one.
+func (s *Server) Cancel() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.current == nil {
+		return false
+	}
+
+	s.log.Info("canceling operation", "operation", s.current.Kind)
+	s.current.cancel()
+	return true
+}
+
+// Wait waits for the running operation to finish, if any.
+func (s *Server) Wait() {
+	s.mu.Lock()
+	done := s.done
+	s.mu.Unlock()
+
+	if done != nil {
+		<-done
+	}
+}
+
+// Serve serves the HTTP API on the address until the context is done, then waits for the running operation.
+func Serve(ctx context.Context, addr string) error {
+	config, err := Config()
+	if err != nil {
+		return err
+	}
+
+	if config.Serve.Token == "" {
+		return fmt.Errorf("SERVE_TOKEN is required")
+	}
+
+	shutdown, err := SetupTracing(ctx, config.Tracing)
+	if err != nil {
+		return err
+	}
+	defer shutdown(context.WithoutCancel(ctx))
+
+	l := slog.New(slog.NewTextHandler(os.Stdout, nil))
+	s := NewServer(ctx, config, l)
+	server := &http.Server{Addr: addr, Handler: s.Handler()}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	l.Info("serving", "addr", addr)
+	err = server.ListenAndServe()
+	s.Wait()
+	if errors.Is(err, http.ErrServerClosed) {
+		return nil
+	}
+
+	return err
+}
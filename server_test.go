@@ -0,0 +1,125 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"testing"
+)
+
+func TestServer(t *testing.T) {
+	config := BackupConfig{Serve: ServeConfig{Token: "secret"}}
+	s := NewServer(context.Background(), config, slog.Default())
+	server := httptest.NewServer(s.Handler())
+	defer server.Close()
+
+	request := func(method, path, token string) *http.Response {
+		req, err := http.NewRequest(method, server.URL+path, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+
+		res, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return res
+	}
+
+	if res := request("GET", "/status", "wrong"); res.StatusCode != http.StatusUnauthorized {
+		t.Errorf("expected unauthorized, got %s", res.Status)
+	}
+
+	if res := request("GET", "/healthz", ""); res.StatusCode != http.StatusNoContent {
+		t.Errorf("expected healthz without token, got %s", res.Status)
+	}
+
+	started := make(chan struct{})
+	_, err := s.Start(operationBackup, func(ctx context.Context, op *Operation) error {
+		op.progress.Begin(op.StartedAt, 2)
+		op.progress.Start("logs")
+		op.progress.Done("data", "exit status 5")
+		close(started)
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-started
+
+	if _, err := s.Start(operationRestore, nil); err == nil {
+		t.Error("expected conflict while a backup is running")
+	}
+
+	res := request("GET", "/status", "secret")
+	var status Status
+	if err := json.NewDecoder(res.Body).Decode(&status); err != nil {
+		t.Fatal(err)
+	}
+	if status.Current == nil || status.Current.Kind != operationBackup || status.Current.Progress.Buckets != 2 {
+		t.Errorf("expected running backup, got %+v", status.Current)
+	}
+
+	want := []BucketProgress{{Name: "data", State: bucketFailed, Error: "exit status 5"}, {Name: "logs", State: bucketRunning}}
+	if status.Current != nil && !slices.Equal(status.Current.Progress.BucketStates, want) {
+		t.Errorf("expected bucket states %+v, got %+v", want, status.Current.Progress.BucketStates)
+	}
+
+	if res := request("POST", "/cancel", "secret"); res.StatusCode != http.StatusAccepted {
+		t.Errorf("expected cancel to be accepted, got %s", res.Status)
+	}
+	s.Wait()
+
+	status = s.Status()
+	if status.Current != nil || status.Last == nil || status.Last.Error != context.Canceled.Error() || status.Last.FinishedAt == nil {
+		t.Errorf("expected canceled backup, got %+v", status)
+	}
+
+	if res := request("POST", "/cancel", "secret"); res.StatusCode != http.StatusConflict {
+		t.Errorf("expected conflict without running operation, got %s", res.Status)
+	}
+
+	// runs can't be listed without rclone, which isn't the same as a missing run
+	t.Setenv("PATH", "")
+	if res := request("GET", "/runs/20240101T000000Z", "secret"); res.StatusCode != http.StatusInternalServerError {
+		t.Errorf("expected internal error when runs can't be listed, got %s", res.Status)
+	}
+}
+
+func TestRestoreRequest(t *testing.T) {
+	none := ""
+	opts, err := RestoreRequest{Run: "20240101T000000Z", Meta: &none, Buckets: []string{"logs-*"}}.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if opts.Meta.Any() || opts.Run != "20240101T000000Z" || opts.At != nil {
+		t.Errorf("unexpected options %+v", opts)
+	}
+
+	opts, err = RestoreRequest{}.Options()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !opts.Meta.Any() {
+		t.Error("expected metadata to be restored by default")
+	}
+
+	buckets, err := selectBuckets([]string{"logs-*", "data"}, []string{"data", "logs-1", "logs-2", "other"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []string{"logs-1", "logs-2", "data"}; !slices.Equal(buckets, want) {
+		t.Errorf("expected %q, got %q", want, buckets)
+	}
+
+	if _, err := selectBuckets([]string{"missing"}, []string{"data"}); err == nil {
+		t.Error("expected error for missing bucket")
+	}
+}
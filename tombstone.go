@@ -0,0 +1,256 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+	"time"
+)
+
+const (
+	// tombstonesDir is the directory in the crypt remote holding the tombstone log of each bucket backed up in copy mode.
+	tombstonesDir = stateDir + "/tombstones"
+
+	// rcloneExitFileNotFound is the exit code of rclone when the requested file doesn't exist.
+	rcloneExitFileNotFound = 4
+)
+
+const (
+	// backupModeSync propagates deletions on the source to the backup immediately.
+	backupModeSync = "sync"
+	// backupModeCopy keeps objects deleted on the source in the backup until their deletion grace period expires.
+	backupModeCopy = "copy"
+)
+
+// validateBackupMode checks the backup mode, an empty mode is the default sync mode.
+func validateBackupMode(mode string) error {
+	switch mode {
+	case "", backupModeSync, backupModeCopy:
+		return nil
+	default:
+		return fmt.Errorf("invalid backup mode %q, expected %s or %s", mode, backupModeSync, backupModeCopy)
+	}
+}
+
+// Tombstones is the tombstone log of a bucket backed up in copy mode.
+// It maps the objects deleted on the source but still kept in the backup to the time their deletion was first noticed.
+type Tombstones map[string]time.Time
+
+// Update records the objects of the backup missing from the source as deleted at now,
+// and forgets the objects that reappeared on the source or are gone from the backup.
+// It returns the objects deleted for longer than grace, sorted. Nothing expires if grace isn't positive.
+func (t Tombstones) Update(source, backup []string, now time.Time, grace time.Duration) []string {
+	present := make(map[string]bool, len(source))
+	for _, name := range source {
+		present[name] = true
+	}
+
+	backedUp := make(map[string]bool, len(backup))
+	for _, name := range backup {
+		backedUp[name] = true
+		if _, ok := t[name]; !ok && !present[name] {
+			t[name] = now
+		}
+	}
+
+	var expired []string
+	for name, deleted := range t {
+		if present[name] || !backedUp[name] {
+			delete(t, name)
+			continue
+		}
+
+		if grace > 0 && !now.Before(deleted.Add(grace)) {
+			expired = append(expired, name)
+		}
+	}
+
+	slices.Sort(expired)
+	return expired
+}
+
+type TombstonesOptions struct {
+	Bucket string
+	log    *slog.Logger
+}
+
+// RcloneReadTombstones reads the tombstone log of a bucket from the crypt remote.
+// An empty log is returned if the bucket has none yet.
+func RcloneReadTombstones(ctx context.Context, config BackupConfig, opts TombstonesOptions) (Tombstones, error) {
+	buf := bytes.NewBuffer(nil)
+	err := RcloneCat(ctx, config, CatOptions{
+		Path:   path.Join(tombstonesDir, opts.Bucket+".json"),
+		Source: config.Crypt.Name,
+		Out:    buf,
+		log:    opts.log,
+	})
+	var exitErr *exec.ExitError
+	if errors.As(err, &exitErr) && (exitErr.ExitCode() == rcloneExitDirNotFound || exitErr.ExitCode() == rcloneExitFileNotFound) {
+		return Tombstones{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	t := Tombstones{}
+	if buf.Len() == 0 {
+		return t, nil
+	}
+
+	if err := json.Unmarshal(buf.Bytes(), &t); err != nil {
+		return nil, fmt.Errorf("decode tombstones: %w", err)
+	}
+
+	return t, nil
+}
+
+// RcloneWriteTombstones stores the tombstone log of a bucket in the crypt remote.
+func RcloneWriteTombstones(ctx context.Context, config BackupConfig, t Tombstones, opts TombstonesOptions) error {
+	dir, err := os.MkdirTemp("", "s32s3-*")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(dir)
+
+	data, err := json.Marshal(t)
+	if err != nil {
+		return fmt.Errorf("marshal tombstones: %w", err)
+	}
+
+	file := filepath.Join(dir, opts.Bucket+".json")
+	err = os.WriteFile(file, append(data, '\n'), 0o644)
+	if err != nil {
+		return err
+	}
+
+	return RcloneSyncFile(ctx, config, SyncFileOptions{
+		File: file,
+		Dest: config.Crypt.Name,
+		Dir:  tombstonesDir,
+		log:  opts.log,
+	})
+}
+
+type DeleteFilesOptions struct {
+	Files  []string
+	Remote string
+	Dir    string
+	log    *slog.Logger
+}
+
+// RcloneDeleteFiles deletes the specified files, relative to Dir, from the remote using the rclone command.
+func RcloneDeleteFiles(ctx context.Context, config BackupConfig, opts DeleteFilesOptions) error {
+	list, err := os.CreateTemp("", "files")
+	if err != nil {
+		return fmt.Errorf("create temp file: %w", err)
+	}
+	defer os.Remove(list.Name())
+	defer list.Close()
+
+	_, err = list.WriteString(strings.Join(opts.Files, "\n") + "\n")
+	if err != nil {
+		return err
+	}
+
+	opts.log.Info("deleting files", "files", len(opts.Files))
+	err = rcloneCmd{
+		args: []string{
+			"delete",
+			"--files-from-raw", list.Name(),
+			fmt.Sprintf("%s:%s", opts.Remote, opts.Dir),
+		},
+		remotes: []string{opts.Remote},
+		log:     opts.log,
+	}.run(ctx, config)
+	if err != nil {
+		return err
+	}
+
+	opts.log.Info("rclone delete complete")
+	return nil
+}
+
+type ExpireDeletedOptions struct {
+	Bucket string
+	Source string
+	// SourceAt is the time the source was copied at, if the bucket was copied as of a point in time.
+	SourceAt *string
+	Dest     string
+	Filter   *ObjectFilter
+	Grace    time.Duration
+	Guard    DeleteGuard
+	Now      time.Time
+	log      *slog.Logger
+}
+
+// RcloneExpireDeleted updates the tombstone log of a bucket backed up in copy mode,
+// and deletes the objects from the backup whose deletion grace period expired.
+// It returns the number of objects still kept after their deletion on the source, and the number of deleted objects.
+// The source is listed as of SourceAt, so that objects are tombstoned against the snapshot that was copied.
+// Objects excluded by Filter are never considered deleted. If Guard prevents the deletion,
+// the tombstone log is stored nonetheless and a *MassDeletionError returned.
+func RcloneExpireDeleted(ctx context.Context, config BackupConfig, opts ExpireDeletedOptions) (int, int, error) {
+	list := func(remote string, sourceAt *string) ([]string, error) {
+		return RcloneListObjects(ctx, config, ListOptions{
+			Path:     opts.Bucket,
+			Remote:   remote,
+			SourceAt: sourceAt,
+			Filter:   opts.Filter,
+			log:      opts.log,
+		})
+	}
+
+	source, err := list(opts.Source, opts.SourceAt)
+	if err != nil {
+		return 0, 0, fmt.Errorf("list source: %w", err)
+	}
+
+	backup, err := list(opts.Dest, nil)
+	if err != nil {
+		return 0, 0, fmt.Errorf("list backup: %w", err)
+	}
+
+	t, err := RcloneReadTombstones(ctx, config, TombstonesOptions{Bucket: opts.Bucket, log: opts.log})
+	if err != nil {
+		return 0, 0, fmt.Errorf("read tombstones: %w", err)
+	}
+
+	expired := t.Update(source, backup, opts.Now, opts.Grace)
+	guardErr := opts.Guard.Check(len(expired), len(backup))
+	if guardErr != nil {
+		expired = nil
+	}
+
+	if len(expired) > 0 {
+		opts.log.Info("deleting objects past their deletion grace period", "count", len(expired))
+		err = RcloneDeleteFiles(ctx, config, DeleteFilesOptions{
+			Files:  expired,
+			Remote: opts.Dest,
+			Dir:    opts.Bucket,
+			log:    opts.log,
+		})
+		if err != nil {
+			return 0, 0, err
+		}
+
+		for _, name := range expired {
+			delete(t, name)
+		}
+	}
+
+	err = RcloneWriteTombstones(ctx, config, t, TombstonesOptions{Bucket: opts.Bucket, log: opts.log})
+	if err != nil {
+		return 0, 0, fmt.Errorf("write tombstones: %w", err)
+	}
+
+	return len(t), len(expired), guardErr
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestTombstonesUpdate(t *testing.T) {
+	now := time.Date(2024, 5, 10, 0, 0, 0, 0, time.UTC)
+	grace := 7 * 24 * time.Hour
+	tombstones := Tombstones{
+		"old.txt":      now.Add(-8 * 24 * time.Hour),
+		"recent.txt":   now.Add(-time.Hour),
+		"restored.txt": now.Add(-30 * 24 * time.Hour),
+		"gone.txt":     now.Add(-time.Hour),
+	}
+
+	expired := tombstones.Update(
+		[]string{"kept.txt", "restored.txt"},
+		[]string{"kept.txt", "restored.txt", "old.txt", "recent.txt", "new.txt"},
+		now, grace,
+	)
+	if want := []string{"old.txt"}; !slices.Equal(expired, want) {
+		t.Errorf("expected expired %q, got %q", want, expired)
+	}
+
+	if want := []string{"new.txt", "old.txt", "recent.txt"}; !slices.Equal(mapKeys(tombstones), want) {
+		t.Errorf("expected tombstones %q, got %q", want, mapKeys(tombstones))
+	}
+
+	if !tombstones["new.txt"].Equal(now) {
+		t.Errorf("expected new.txt deleted at %s, got %s", now, tombstones["new.txt"])
+	}
+
+	if expired := tombstones.Update(nil, []string{"old.txt"}, now, 0); len(expired) != 0 {
+		t.Errorf("expected nothing to expire without grace period, got %q", expired)
+	}
+
+	if err := validateBackupMode("mirror"); err == nil {
+		t.Error("expected error for invalid backup mode")
+	}
+}
@@ -0,0 +1,147 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracer traces backups and restores. Spans are dropped unless tracing is set up.
+var tracer = otel.Tracer("github.com/kraudcloud/s32s3")
+
+// TracingConfig configures exporting traces of backups and restores over OTLP.
+type TracingConfig struct {
+	// Endpoint is the base URL of the OTLP/HTTP receiver, such as http://otel-collector:4318.
+	// Traces are posted to /v1/traces, unless the URL has a path. Tracing is disabled if empty.
+	Endpoint string `config:"ENDPOINT"`
+}
+
+// Validate checks the endpoint of the configuration.
+func (c TracingConfig) Validate() error {
+	if c.Endpoint == "" {
+		return nil
+	}
+
+	_, err := c.endpointURL()
+	return err
+}
+
+func (c TracingConfig) endpointURL() (string, error) {
+	u, err := url.Parse(c.Endpoint)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return "", fmt.Errorf("invalid tracing endpoint %q, expected an http or https URL", c.Endpoint)
+	}
+
+	if strings.Trim(u.Path, "/") == "" {
+		u.Path = "/v1/traces"
+	}
+
+	return u.String(), nil
+}
+
+// SetupTracing exports traces to the configured endpoint, if any.
+// The returned function flushes the pending spans and stops exporting.
+func SetupTracing(ctx context.Context, config TracingConfig) (func(context.Context) error, error) {
+	if config.Endpoint == "" {
+		return func(context.Context) error { return nil }, nil
+	}
+
+	endpoint, err := config.endpointURL()
+	if err != nil {
+		return nil, err
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("create trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", "s32s3"),
+		attribute.String("service.version", toolVersion()),
+	))
+	if err != nil {
+		return nil, err
+	}
+
+	provider := sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+	)
+	otel.SetTracerProvider(provider)
+
+	return provider.Shutdown, nil
+}
+
+// endSpan ends the span, recording the error if it failed.
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
+
+// traced runs fn in a span with the name.
+func traced[T any](ctx context.Context, name string, fn func(ctx context.Context) (T, error)) (T, error) {
+	ctx, span := tracer.Start(ctx, name)
+	out, err := fn(ctx)
+	endSpan(span, err)
+	return out, err
+}
+
+// traceBucket runs fn for a bucket in a span with the name, and records its duration in the outcome of the bucket.
+// The bucket is marked as running and then done or failed in the progress,
+// which the bytes and objects transferred for the bucket are taken from.
+func traceBucket(ctx context.Context, name string, progress *Progress, fn func(ctx context.Context, bucket *string) BucketRun) func(bucket *string) BucketRun {
+	return func(bucket *string) BucketRun {
+		start := time.Now()
+		progress.Start(*bucket)
+		ctx, span := tracer.Start(ctx, name, trace.WithAttributes(attribute.String("s32s3.bucket", *bucket)))
+		result := fn(ctx, bucket)
+		result.Duration = time.Since(start).Round(time.Second).String()
+		progress.Done(*bucket, result.Error)
+
+		stats := progress.Bucket(*bucket)
+		span.SetAttributes(
+			attribute.Int("s32s3.attempts", result.Attempts),
+			attribute.Int64("s32s3.bytes", stats.Bytes),
+			attribute.Int64("s32s3.objects", stats.Transfers),
+			attribute.Int64("s32s3.errors", stats.Errors),
+		)
+
+		if result.Error != "" {
+			span.SetStatus(codes.Error, result.Error)
+		}
+		span.End()
+
+		return result
+	}
+}
+
+// endRunSpan ends the span of a backup or restore, which failed if err is set or any bucket failed.
+func endRunSpan(span trace.Span, id string, buckets []BucketRun, err error) {
+	failed := failedBuckets(buckets)
+	span.SetAttributes(
+		attribute.String("s32s3.run", id),
+		attribute.Int("s32s3.buckets", len(buckets)),
+		attribute.StringSlice("s32s3.failed", failed),
+	)
+
+	if err == nil && len(failed) > 0 {
+		span.SetStatus(codes.Error, fmt.Sprintf("%d buckets failed", len(failed)))
+	}
+
+	endSpan(span, err)
+}
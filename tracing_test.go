@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"testing"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+func TestTracingEndpoint(t *testing.T) {
+	for endpoint, expected := range map[string]string{
+		"http://collector:4318":            "http://collector:4318/v1/traces",
+		"https://collector:4318/":          "https://collector:4318/v1/traces",
+		"https://collector/otlp/v1/traces": "https://collector/otlp/v1/traces",
+		"collector:4318":                   "",
+		"grpc://collector:4317":            "",
+		"http://":                          "",
+	} {
+		out, err := TracingConfig{Endpoint: endpoint}.endpointURL()
+		if expected == "" {
+			if err == nil {
+				t.Errorf("expected error for %s", endpoint)
+			}
+			continue
+		}
+
+		if err != nil || out != expected {
+			t.Errorf("expected %s for %s, got %s, %v", expected, endpoint, out, err)
+		}
+	}
+}
+
+func TestTraceBucket(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	previous := otel.GetTracerProvider()
+	otel.SetTracerProvider(provider)
+	t.Cleanup(func() {
+		otel.SetTracerProvider(previous)
+		provider.Shutdown(context.Background())
+	})
+
+	progress := NewProgress()
+	progress.Update("a", rcloneStats{Bytes: 42, Transfers: 2})
+
+	ctx, span := tracer.Start(context.Background(), "backup")
+	fn := traceBucket(ctx, "backup bucket", progress, func(ctx context.Context, bucket *string) BucketRun {
+		out := BucketRun{Name: *bucket, Attempts: 1}
+		if *bucket == "b" {
+			out.Error = "exit status 5"
+		}
+		return out
+	})
+
+	a, b := "a", "b"
+	buckets := []BucketRun{fn(&a), fn(&b)}
+	if buckets[0].Duration == "" {
+		t.Error("expected bucket duration")
+	}
+	endRunSpan(span, "20240101T000000Z", buckets, nil)
+
+	spans := exporter.GetSpans()
+	if len(spans) != 3 {
+		t.Fatalf("expected 3 spans, got %d", len(spans))
+	}
+
+	attrs := func(s tracetest.SpanStub) map[attribute.Key]attribute.Value {
+		out := map[attribute.Key]attribute.Value{}
+		for _, kv := range s.Attributes {
+			out[kv.Key] = kv.Value
+		}
+		return out
+	}
+
+	if s := spans[0]; s.Name != "backup bucket" || attrs(s)["s32s3.bytes"].AsInt64() != 42 || s.Status.Code == codes.Error {
+		t.Errorf("unexpected span of bucket a: %s %v %v", s.Name, s.Attributes, s.Status)
+	}
+
+	if s := spans[1]; s.Parent.SpanID() != span.SpanContext().SpanID() || s.Status.Code != codes.Error {
+		t.Errorf("expected failed child span for bucket b, got %v", s.Status)
+	}
+
+	if s := spans[2]; s.Status.Code != codes.Error || attrs(s)["s32s3.run"].AsString() != "20240101T000000Z" {
+		t.Errorf("expected run span to fail with a failed bucket, got %v", s.Status)
+	}
+}